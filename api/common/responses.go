@@ -18,32 +18,65 @@ package common
 
 import (
 	"net/http"
+
+	"github.com/t2bot/matrix-key-server/federation"
 )
 
 type EmptyResponse struct{}
 
+// HeadersResponse sets the given headers on the HTTP response, in addition to replying with Body.
+type HeadersResponse struct {
+	Headers http.Header
+	Body    interface{}
+}
+
 type ErrorResponse struct {
 	Code       string `json:"errcode"`
 	Message    string `json:"error"`
 	HttpStatus int    `json:"http_status"`
+	Reason     string `json:"reason,omitempty"`
 }
 
 func InternalServerError(message string) *ErrorResponse {
-	return &ErrorResponse{"M_UNKNOWN", message, http.StatusInternalServerError}
+	return &ErrorResponse{Code: "M_UNKNOWN", Message: message, HttpStatus: http.StatusInternalServerError}
 }
 
 func MethodNotAllowed() *ErrorResponse {
-	return &ErrorResponse{"M_UNKNOWN", "Method Not Allowed", http.StatusMethodNotAllowed}
+	return &ErrorResponse{Code: "M_UNKNOWN", Message: "Method Not Allowed", HttpStatus: http.StatusMethodNotAllowed}
 }
 
 func NotFoundError() *ErrorResponse {
-	return &ErrorResponse{"M_NOT_FOUND", "Resource Not Found", http.StatusNotFound}
+	return &ErrorResponse{Code: "M_NOT_FOUND", Message: "Resource Not Found", HttpStatus: http.StatusNotFound}
 }
 
 func UnauthorizedError() *ErrorResponse {
-	return &ErrorResponse{"M_UNAUTHORIZED", "Authentication Failed", http.StatusUnauthorized}
+	return &ErrorResponse{Code: "M_UNAUTHORIZED", Message: "Authentication Failed", HttpStatus: http.StatusUnauthorized}
 }
 
 func BadRequest(message string) *ErrorResponse {
-	return &ErrorResponse{"M_UNKNOWN", message, http.StatusBadRequest}
+	return &ErrorResponse{Code: "M_UNKNOWN", Message: message, HttpStatus: http.StatusBadRequest}
+}
+
+func Forbidden(message string) *ErrorResponse {
+	return &ErrorResponse{Code: "M_FORBIDDEN", Message: message, HttpStatus: http.StatusForbidden}
+}
+
+// RemoteServerError describes a failure to get something from a remote server. Problems with
+// the remote server are reported as a 502 (or 504 for timeouts) with the kind of failure as
+// the reason, so callers can tell them apart from problems with the key server itself, which
+// remain a 500 without a reason.
+func RemoteServerError(err error, message string) *ErrorResponse {
+	kind := federation.Classify(err)
+	switch kind {
+	case federation.ErrorKindUnknown:
+		return InternalServerError(message)
+	case federation.ErrorKindTimeout:
+		return &ErrorResponse{Code: "M_UNKNOWN", Message: message, HttpStatus: http.StatusGatewayTimeout, Reason: string(kind)}
+	case federation.ErrorKindRateLimited:
+		return &ErrorResponse{Code: "M_LIMIT_EXCEEDED", Message: message, HttpStatus: http.StatusTooManyRequests, Reason: string(kind)}
+	case federation.ErrorKindDenied:
+		return &ErrorResponse{Code: "M_FORBIDDEN", Message: message, HttpStatus: http.StatusForbidden, Reason: string(kind)}
+	default:
+		return &ErrorResponse{Code: "M_UNKNOWN", Message: message, HttpStatus: http.StatusBadGateway, Reason: string(kind)}
+	}
 }
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/janitor"
+	"github.com/t2bot/matrix-key-server/keys"
+)
+
+type CachedServerInfo struct {
+	UpdatedTs    models.Timestamp `json:"updated_ts"`
+	ValidUntilTs models.Timestamp `json:"valid_until_ts"`
+	KeyIDs       []models.KeyID   `json:"key_ids"`
+}
+
+type ServerDiagnosticsResponse struct {
+	ServerName   models.ServerName          `json:"server_name"`
+	Cached       *CachedServerInfo          `json:"cached"`
+	FailedLookup *keys.FailedLookup         `json:"failed_lookup"`
+	Resolution   *federation.ResolvedServer `json:"resolution"`
+}
+
+func ServerDiagnostics(r *http.Request, log *logrus.Entry) interface{} {
+	serverName := models.ServerName(mux.Vars(r)["serverName"])
+
+	resp := &ServerDiagnosticsResponse{
+		ServerName:   serverName,
+		FailedLookup: keys.GetFailedLookup(serverName),
+		Resolution:   federation.GetCachedResolution(string(serverName)),
+	}
+
+	s, err := db.GetRemoteServerMetadata(serverName)
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("Failed to get cached server")
+	}
+	if s != nil {
+		remoteKeys, err := db.GetAllRemoteServerKeys(serverName)
+		if err != nil {
+			log.Error(err)
+			return common.InternalServerError("Failed to get cached keys")
+		}
+
+		resp.Cached = &CachedServerInfo{
+			UpdatedTs:    s.UpdatedTs,
+			ValidUntilTs: s.ValidUntilTs,
+			KeyIDs:       make([]models.KeyID, 0),
+		}
+		for _, k := range remoteKeys {
+			resp.Cached.KeyIDs = append(resp.Cached.KeyIDs, k.ID)
+		}
+	}
+
+	return resp
+}
+
+func JanitorDiagnostics(r *http.Request, log *logrus.Entry) interface{} {
+	stats := janitor.GetStats()
+	return &stats
+}
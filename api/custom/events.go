@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/keys"
+)
+
+type VerifyEventRequest struct {
+	RoomVersion string                 `json:"room_version"`
+	EventId     string                 `json:"event_id,omitempty"`
+	Event       map[string]interface{} `json:"event"`
+}
+
+type EventServerResult struct {
+	Required bool   `json:"required"`
+	Verified bool   `json:"verified"`
+	KeyID    string `json:"key_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type VerifyEventResponse struct {
+	RoomVersion      string                        `json:"room_version"`
+	ReferenceHash    string                        `json:"reference_hash"`
+	EventId          string                        `json:"event_id,omitempty"`
+	EventIdValid     *bool                         `json:"event_id_valid,omitempty"`
+	ContentHashValid bool                          `json:"content_hash_valid"`
+	Redact           bool                          `json:"redact"`
+	SignaturesValid  bool                          `json:"signatures_valid"`
+	Servers          map[string]*EventServerResult `json:"servers"`
+}
+
+// VerifyEvent checks the content hash and signatures of a PDU, reporting each signing server's
+// result, whether the event must be redacted, and the event's ID.
+func VerifyEvent(r *http.Request, log *logrus.Entry) interface{} {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("Failed to read body")
+	}
+
+	req := &VerifyEventRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Body not JSON")
+	}
+	if req.RoomVersion == "" || req.Event == nil {
+		return common.BadRequest("Missing room_version or event")
+	}
+
+	verification, err := keys.VerifyEvent(req.Event, req.RoomVersion, req.EventId)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Unable to check event: " + err.Error())
+	}
+
+	resp := &VerifyEventResponse{
+		RoomVersion:      verification.RoomVersion.Id,
+		ReferenceHash:    verification.ReferenceHash,
+		EventId:          verification.EventId,
+		EventIdValid:     verification.EventIdValid,
+		ContentHashValid: verification.ContentHashValid,
+		Redact:           verification.Redact,
+		SignaturesValid:  verification.SignaturesValid,
+		Servers:          make(map[string]*EventServerResult),
+	}
+	for serverName, s := range verification.Servers {
+		res := &EventServerResult{
+			Required: s.Required,
+			Verified: s.Verified,
+			KeyID:    string(s.KeyID),
+			Reason:   s.Reason,
+		}
+		if s.Err != nil {
+			res.Error = s.Err.Error()
+		}
+		resp.Servers[serverName] = res
+	}
+	return resp
+}
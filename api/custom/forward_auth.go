@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/keys"
+)
+
+// ForwardAuthDestination is the server name forwarded requests are expected to be sent to. When
+// empty, keys.SelfDomainName is used. The forwarded host is never used, as proxies usually copy
+// it from the client's Host header.
+var ForwardAuthDestination string
+
+const (
+	HeaderMatrixOrigin = "X-Matrix-Origin"
+	HeaderMatrixKeyId  = "X-Matrix-Key-Id"
+)
+
+// ForwardAuth verifies the X-Matrix signature on a request described by the headers a reverse
+// proxy sends with an auth request (nginx's auth_request, Traefik's ForwardAuth, or Caddy's
+// forward_auth). Verified requests get a 200 with the origin in the X-Matrix-Origin header.
+func ForwardAuth(r *http.Request, log *logrus.Entry) interface{} {
+	// Most proxies don't pass the body on, in which case only requests without one can pass
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("Failed to read body")
+	}
+
+	req, errRes := forwardedRequest(r.Header, b)
+	if errRes != nil {
+		return errRes
+	}
+
+	verified, err := keys.VerifyRequest(req)
+	if err != nil {
+		authErr := &keys.AuthError{}
+		if errors.As(err, &authErr) {
+			log = log.WithField("reason", authErr.Reason)
+		}
+		log.Warn(err)
+		return authErrorResponse(err)
+	}
+
+	log.Infof("Verified request from %s with %s", verified.Origin, verified.KeyID)
+	return &common.HeadersResponse{
+		Headers: http.Header{
+			HeaderMatrixOrigin: []string{verified.Origin},
+			HeaderMatrixKeyId:  []string{string(verified.KeyID)},
+		},
+		Body: &CheckAuthResponse{
+			Verified: true,
+			Origin:   verified.Origin,
+			KeyID:    string(verified.KeyID),
+		},
+	}
+}
+
+// forwardedRequest rebuilds the request a proxy is asking about from its forwarding headers. The
+// destination is ForwardAuthDestination, or keys.SelfDomainName without it. Neither the forwarded
+// host nor X-Keys-Destination is read here, as proxies may well pass them on from the client.
+func forwardedRequest(headers http.Header, body []byte) (*keys.SignedRequest, *common.ErrorResponse) {
+	method := firstHeader(headers, "X-Forwarded-Method", "X-Original-Method")
+	uri := firstHeader(headers, "X-Forwarded-Uri", "X-Original-URI")
+	if uri == "" {
+		// Some proxies only send the full URL
+		if u, err := url.Parse(headers.Get("X-Original-URL")); err == nil && u.Path != "" {
+			uri = u.RequestURI()
+		}
+	}
+	if method == "" || uri == "" {
+		return nil, common.BadRequest("Missing forwarded method or URI")
+	}
+
+	destination := ForwardAuthDestination
+	if destination == "" {
+		destination = keys.SelfDomainName
+	}
+
+	return &keys.SignedRequest{
+		Method:        strings.ToUpper(method),
+		Uri:           uri,
+		Destination:   destination,
+		Content:       body,
+		Authorization: headers.Values("Authorization"),
+	}, nil
+}
+
+func firstHeader(headers http.Header, names ...string) string {
+	for _, name := range names {
+		if v := headers.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/keys"
+)
+
+func TestForwardedRequest(t *testing.T) {
+	previous := keys.SelfDomainName
+	keys.SelfDomainName = "keys.example.org"
+	defer func() {
+		ForwardAuthDestination = ""
+		keys.SelfDomainName = previous
+	}()
+
+	tests := []struct {
+		name              string
+		headers           map[string]string
+		configured        string
+		expectError       bool
+		expectMethod      string
+		expectUri         string
+		expectDestination string
+	}{
+		{
+			name: "traefik",
+			headers: map[string]string{
+				"X-Forwarded-Method": "GET",
+				"X-Forwarded-Uri":    "/_matrix/federation/v1/version?a=b",
+				"X-Forwarded-Host":   "matrix.example.org",
+			},
+			configured:        "example.org",
+			expectMethod:      "GET",
+			expectUri:         "/_matrix/federation/v1/version?a=b",
+			expectDestination: "example.org",
+		},
+		{
+			name: "nginx",
+			headers: map[string]string{
+				"X-Original-Method": "put",
+				"X-Original-URI":    "/_matrix/federation/v1/send/1",
+				"X-Original-Host":   "other.example.org",
+			},
+			configured:        "example.org",
+			expectMethod:      "PUT",
+			expectUri:         "/_matrix/federation/v1/send/1",
+			expectDestination: "example.org",
+		},
+		{
+			name: "full url",
+			headers: map[string]string{
+				"X-Original-Method": "GET",
+				"X-Original-URL":    "https://example.org/_matrix/federation/v1/query/profile?user_id=%40a%3Ab",
+				"X-Original-Host":   "example.org",
+			},
+			configured:        "example.org",
+			expectMethod:      "GET",
+			expectUri:         "/_matrix/federation/v1/query/profile?user_id=%40a%3Ab",
+			expectDestination: "example.org",
+		},
+		{
+			name: "configured destination wins over host",
+			headers: map[string]string{
+				"X-Forwarded-Method": "GET",
+				"X-Forwarded-Uri":    "/",
+				"X-Forwarded-Host":   "matrix.example.org",
+			},
+			configured:        "example.org",
+			expectMethod:      "GET",
+			expectUri:         "/",
+			expectDestination: "example.org",
+		},
+		{
+			name: "configured destination wins over X-Keys-Destination",
+			headers: map[string]string{
+				"X-Forwarded-Method": "GET",
+				"X-Forwarded-Uri":    "/",
+				"X-Keys-Destination": "other.example.org",
+			},
+			configured:        "example.org",
+			expectMethod:      "GET",
+			expectUri:         "/",
+			expectDestination: "example.org",
+		},
+		{
+			name: "forwarded hosts are ignored without a configured destination",
+			headers: map[string]string{
+				"X-Forwarded-Method": "GET",
+				"X-Forwarded-Uri":    "/",
+				"X-Forwarded-Host":   "matrix.example.org",
+				"X-Original-Host":    "matrix.example.org",
+				"X-Keys-Destination": "other.example.org",
+			},
+			expectMethod:      "GET",
+			expectUri:         "/",
+			expectDestination: "keys.example.org",
+		},
+		{
+			name:        "missing method",
+			headers:     map[string]string{"X-Forwarded-Uri": "/"},
+			expectError: true,
+		},
+		{
+			name:        "missing uri",
+			headers:     map[string]string{"X-Forwarded-Method": "GET"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ForwardAuthDestination = tt.configured
+			headers := make(http.Header)
+			for k, v := range tt.headers {
+				headers.Set(k, v)
+			}
+			headers.Add("Authorization", "X-Matrix origin=a")
+
+			req, errRes := forwardedRequest(headers, nil)
+			if tt.expectError {
+				if errRes == nil {
+					t.Fatalf("expected an error, got %+v", req)
+				}
+				return
+			}
+			if errRes != nil {
+				t.Fatalf("unexpected error: %+v", errRes)
+			}
+			if req.Method != tt.expectMethod || req.Uri != tt.expectUri || req.Destination != tt.expectDestination {
+				t.Errorf("got %s %s to %q, expected %s %s to %q", req.Method, req.Uri, req.Destination, tt.expectMethod, tt.expectUri, tt.expectDestination)
+			}
+			if len(req.Authorization) != 1 {
+				t.Errorf("expected the Authorization header to be passed on, got %v", req.Authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/keys"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+// Kinds of signing request.
+const (
+	SignKindEvent  = "event"
+	SignKindObject = "object"
+)
+
+// Outcomes recorded in the signing audit log.
+const (
+	SignOutcomeSigned  = "signed"
+	SignOutcomeRefused = "refused"
+	SignOutcomeFailed  = "failed"
+)
+
+const minSigningTokenLength = 32
+
+// maxAuditFieldLength is the length of the signing_audit columns filled from the request body.
+const maxAuditFieldLength = 32
+
+// addSigningAuditRecord is replaced in tests which don't have a database.
+var addSigningAuditRecord = db.AddSigningAuditRecord
+
+type signingCaller struct {
+	name  string
+	token []byte
+}
+
+var signingCallers = make([]*signingCaller, 0)
+var signingAllowedNets = make([]*net.IPNet, 0)
+
+// SetSigningTokens configures who may use the signing service, as "name=token" pairs. The name
+// identifies the caller in the audit log. With no tokens, the signing service is disabled.
+func SetSigningTokens(pairs []string) error {
+	callers := make([]*signingCaller, 0, len(pairs))
+	for _, pair := range pairs {
+		name, token, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return errors.New("signing tokens must be given as name=token")
+		}
+		if len(token) < minSigningTokenLength {
+			return fmt.Errorf("signing token for %s must be at least %d characters", name, minSigningTokenLength)
+		}
+		callers = append(callers, &signingCaller{name: name, token: []byte(token)})
+	}
+	signingCallers = callers
+	return nil
+}
+
+// SetSigningAllowedRanges limits the addresses the signing service can be used from. With no
+// ranges, any address may use it.
+func SetSigningAllowedRanges(ranges []string) error {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			if ip := net.ParseIP(r); ip != nil && ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	signingAllowedNets = nets
+	return nil
+}
+
+type SignRequest struct {
+	Kind        string                 `json:"kind"`
+	RoomVersion string                 `json:"room_version,omitempty"`
+	Object      map[string]interface{} `json:"object"`
+}
+
+type SignResponse struct {
+	Signed  map[string]interface{} `json:"signed"`
+	KeyID   string                 `json:"key_id"`
+	AuditID int64                  `json:"audit_id"`
+}
+
+// SignAsSelf signs an event or object with this server's key for an authenticated caller.
+// Every attempt by an authenticated caller is recorded in the audit log, and nothing is
+// returned unless the record was stored.
+func SignAsSelf(r *http.Request, log *logrus.Entry) interface{} {
+	if len(signingCallers) == 0 {
+		return common.NotFoundError()
+	}
+
+	caller, errResp := authenticateSigningCaller(r)
+	if errResp != nil {
+		log.Warnf("Refused signing request from %s: %s", r.RemoteAddr, errResp.Message)
+		return errResp
+	}
+	log = log.WithField("caller", caller)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("Failed to read body")
+	}
+
+	req := &SignRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Body not JSON")
+	}
+	if req.Object == nil {
+		return common.BadRequest("Missing object")
+	}
+
+	record := &models.SigningAuditRecord{
+		CreatedTs:   models.Timestamp(util.NowMillis()),
+		Caller:      caller,
+		RemoteAddr:  r.RemoteAddr,
+		Kind:        truncateAuditField(req.Kind),
+		RoomVersion: truncateAuditField(req.RoomVersion),
+	}
+	record.ObjectSha256, err = keys.HashSignableObject(req.Object)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Object can't be encoded as canonical JSON")
+	}
+
+	var signed map[string]interface{}
+	var keyId models.KeyID
+	switch req.Kind {
+	case SignKindEvent:
+		signed, keyId, err = keys.SignEventAsSelf(req.Object, req.RoomVersion)
+	case SignKindObject:
+		signed, keyId, err = keys.SignObjectAsSelf(req.Object)
+	default:
+		err = &keys.SigningRefusedError{Reason: fmt.Sprintf("unknown kind %q", req.Kind)}
+	}
+
+	record.KeyID = keyId
+	record.Outcome = SignOutcomeSigned
+	refusedErr := &keys.SigningRefusedError{}
+	if errors.As(err, &refusedErr) {
+		record.Outcome = SignOutcomeRefused
+		record.Error = err.Error()
+	} else if err != nil {
+		record.Outcome = SignOutcomeFailed
+		record.Error = err.Error()
+	}
+
+	record.ID, err = addSigningAuditRecord(record)
+	if err != nil {
+		log.Error("Failed to store signing audit record: ", err)
+		return common.InternalServerError("Failed to record signing operation")
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"audit_id":      record.ID,
+		"kind":          record.Kind,
+		"object_sha256": record.ObjectSha256,
+		"outcome":       record.Outcome,
+	})
+	switch record.Outcome {
+	case SignOutcomeRefused:
+		log.Warn(record.Error)
+		return &common.ErrorResponse{
+			Code:       "M_FORBIDDEN",
+			Message:    record.Error,
+			HttpStatus: http.StatusForbidden,
+		}
+	case SignOutcomeFailed:
+		log.Error(record.Error)
+		return common.InternalServerError("Failed to sign object")
+	}
+
+	log.Info("Signed object")
+	return &SignResponse{
+		Signed:  signed,
+		KeyID:   string(keyId),
+		AuditID: record.ID,
+	}
+}
+
+// truncateAuditField cuts a value from the request down to fit its audit log column, so an
+// oversized value can't stop the attempt being recorded.
+func truncateAuditField(val string) string {
+	runes := []rune(val)
+	if len(runes) > maxAuditFieldLength {
+		return string(runes[:maxAuditFieldLength])
+	}
+	return val
+}
+
+// authenticateSigningCaller checks the request's address and bearer token, returning the
+// caller's name. Every token is compared so the time taken doesn't reveal which matched.
+func authenticateSigningCaller(r *http.Request) (string, *common.ErrorResponse) {
+	forbidden := &common.ErrorResponse{
+		Code:       "M_FORBIDDEN",
+		Message:    "Not allowed to sign",
+		HttpStatus: http.StatusForbidden,
+	}
+
+	if len(signingAllowedNets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		allowed := false
+		for _, n := range signingAllowedNets {
+			if ip != nil && n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", forbidden
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", &common.ErrorResponse{
+			Code:       "M_MISSING_TOKEN",
+			Message:    "Missing bearer token",
+			HttpStatus: http.StatusUnauthorized,
+		}
+	}
+	token := []byte(strings.TrimSpace(auth[len("Bearer "):]))
+
+	caller := ""
+	for _, c := range signingCallers {
+		if subtle.ConstantTimeCompare(c.token, token) == 1 {
+			caller = c.name
+		}
+	}
+	if caller == "" {
+		return "", &common.ErrorResponse{
+			Code:       "M_UNKNOWN_TOKEN",
+			Message:    "Unknown bearer token",
+			HttpStatus: http.StatusUnauthorized,
+		}
+	}
+	return caller, nil
+}
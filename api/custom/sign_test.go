@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+)
+
+func TestAuthenticateSigningCaller(t *testing.T) {
+	t.Cleanup(func() {
+		_ = SetSigningTokens(nil)
+		_ = SetSigningAllowedRanges(nil)
+	})
+
+	if err := SetSigningTokens([]string{"bridge=short"}); err == nil {
+		t.Error("Expected a short token to be refused")
+	}
+	if err := SetSigningTokens([]string{strings.Repeat("a", 40)}); err == nil {
+		t.Error("Expected a token without a name to be refused")
+	}
+
+	bridgeToken := strings.Repeat("b", 40)
+	err := SetSigningTokens([]string{"bridge=" + bridgeToken, "appservice=" + strings.Repeat("c", 40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetSigningAllowedRanges([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		auth       string
+		caller     string
+		status     int
+	}{
+		{"valid token", "10.1.2.3:1234", "Bearer " + bridgeToken, "bridge", 0},
+		{"lowercase scheme", "[::1]:1234", "bearer " + bridgeToken, "bridge", 0},
+		{"address not allowed", "192.168.1.1:1234", "Bearer " + bridgeToken, "", http.StatusForbidden},
+		{"no token", "10.1.2.3:1234", "", "", http.StatusUnauthorized},
+		{"wrong scheme", "10.1.2.3:1234", "Basic " + bridgeToken, "", http.StatusUnauthorized},
+		{"unknown token", "10.1.2.3:1234", "Bearer " + strings.Repeat("d", 40), "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("POST", "/_matrix/key/unstable/sign", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		caller, errResp := authenticateSigningCaller(r)
+		if c.status != 0 {
+			if errResp == nil || errResp.HttpStatus != c.status {
+				t.Errorf("%s: expected status %d, got %+v", c.name, c.status, errResp)
+			}
+			continue
+		}
+		if errResp != nil || caller != c.caller {
+			t.Errorf("%s: expected caller %s, got %s %+v", c.name, c.caller, caller, errResp)
+		}
+	}
+}
+
+func TestSignAsSelf_AuditsOversizedFields(t *testing.T) {
+	token := strings.Repeat("b", 40)
+	err := SetSigningTokens([]string{"bridge=" + token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*models.SigningAuditRecord
+	addSigningAuditRecord = func(record *models.SigningAuditRecord) (int64, error) {
+		if len(record.Kind) > maxAuditFieldLength || len(record.RoomVersion) > maxAuditFieldLength {
+			t.Errorf("Expected fields to fit their columns, got %q and %q", record.Kind, record.RoomVersion)
+		}
+		records = append(records, record)
+		return int64(len(records)), nil
+	}
+	t.Cleanup(func() {
+		_ = SetSigningTokens(nil)
+		addSigningAuditRecord = db.AddSigningAuditRecord
+	})
+
+	long := strings.Repeat("x", 100)
+	body := `{"kind":"` + long + `","room_version":"` + long + `","object":{"a":1}}`
+	r, _ := http.NewRequest("POST", "/_matrix/key/unstable/sign", bytes.NewBufferString(body))
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	res := SignAsSelf(r, logrus.WithField("test", t.Name()))
+	errResp, ok := res.(*common.ErrorResponse)
+	if !ok || errResp.HttpStatus != http.StatusForbidden {
+		t.Errorf("Expected the unknown kind to be refused, got %+v", res)
+	}
+	if len(records) != 1 || records[0].Outcome != SignOutcomeRefused {
+		t.Fatalf("Expected 1 refused attempt to be recorded, got %+v", records)
+	}
+	if records[0].Kind != long[:maxAuditFieldLength] {
+		t.Errorf("Expected the kind to be truncated, got %q", records[0].Kind)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package custom
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/tester"
+)
+
+func FederationTester(r *http.Request, log *logrus.Entry) interface{} {
+	serverName := mux.Vars(r)["serverName"]
+
+	err := federation.CheckServerAllowed(serverName)
+	if err != nil {
+		log.Warn(err)
+		return common.Forbidden("Server not allowed")
+	}
+
+	return tester.Test(serverName)
+}
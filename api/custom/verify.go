@@ -18,6 +18,8 @@ package custom
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -25,11 +27,47 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-key-server/api/common"
 	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
 	"github.com/t2bot/matrix-key-server/keys"
-	"github.com/t2bot/matrix-key-server/signing"
-	"golang.org/x/crypto/ed25519"
 )
 
+// CheckAuthRequest describes a request to verify. Destination is the server the caller
+// received the request as, and is trusted over the Authorization headers: when it is empty,
+// the request must have been sent to this key server's own name.
+type CheckAuthRequest struct {
+	Method        string          `json:"method"`
+	Uri           string          `json:"uri"`
+	Origin        string          `json:"origin"`
+	Destination   string          `json:"destination"`
+	Content       json.RawMessage `json:"content"`
+	Authorization []string        `json:"authorization"`
+	RequestTs     int64           `json:"request_ts"`
+}
+
+type CheckAuthResponse struct {
+	Verified bool   `json:"verified"`
+	Origin   string `json:"origin"`
+	KeyID    string `json:"key_id"`
+}
+
+type BatchCheckAuthRequest struct {
+	Requests []*CheckAuthRequest `json:"requests"`
+}
+
+type BatchCheckAuthResult struct {
+	Verified bool                  `json:"verified"`
+	Origin   string                `json:"origin,omitempty"`
+	KeyID    string                `json:"key_id,omitempty"`
+	Error    *common.ErrorResponse `json:"error,omitempty"`
+}
+
+type BatchCheckAuthResponse struct {
+	Results []*BatchCheckAuthResult `json:"results"`
+}
+
+// MaxCheckAuthBatchSize is the most requests which can be checked in one batch.
+var MaxCheckAuthBatchSize = 100
+
 func VerifyAuthHeader(r *http.Request, log *logrus.Entry) interface{} {
 	method := r.Header.Get("X-Keys-Method")
 	uri := r.Header.Get("X-Keys-URI")
@@ -45,78 +83,170 @@ func VerifyAuthHeader(r *http.Request, log *logrus.Entry) interface{} {
 		return common.InternalServerError("Failed to read body")
 	}
 
-	auth := r.Header.Get("Authorization")
-	if !strings.HasPrefix(auth, "X-Matrix ") {
-		return common.UnauthorizedError()
+	req := &keys.SignedRequest{
+		Method:        method,
+		Uri:           uri,
+		Destination:   destination,
+		Content:       b,
+		Authorization: r.Header.Values("Authorization"),
 	}
 
-	// Parse the header
-	authParams := map[string]string{}
-	paramCsv := strings.Split(strings.Split(auth, " ")[1], ",")
-	for _, p := range paramCsv {
-		vals := strings.Split(p, "=")
-		if len(vals) != 2 {
-			continue
+	_, err = keys.VerifyRequest(req)
+	if err != nil {
+		log.Warn(err)
+		authErr := &keys.AuthError{}
+		if errors.As(err, &authErr) {
+			switch authErr.Reason {
+			case keys.AuthReasonServerDenied:
+				return common.Forbidden("Origin server not allowed")
+			case keys.AuthReasonKeysUnavailable:
+				return common.RemoteServerError(authErr.Err, "Failed to get remote server keys")
+			}
 		}
+		return common.UnauthorizedError()
+	}
 
-		k := vals[0]
-		v := vals[1]
-		if v[0] == '"' {
-			v = v[1 : len(v)-1]
-		}
+	return common.EmptyResponse{}
+}
 
-		authParams[k] = v
-	}
-
-	origin := authParams["origin"]
-	keyId := authParams["key"]
-	signature := authParams["sig"]
-
-	obj := map[string]interface{}{
-		"method":      method,
-		"uri":         uri,
-		"origin":      origin,
-		"destination": destination,
-		"signatures": map[string]interface{}{
-			origin: map[string]interface{}{
-				keyId: signature,
-			},
-		},
-	}
-	if len(b) > 0 {
-		parsed := make(map[string]interface{})
-		err = json.Unmarshal(b, &parsed)
-		if err != nil {
-			log.Warn("Error parsing JSON body", err)
-		} else {
-			obj["content"] = parsed
-		}
+// VerifyAuthRequest is check_auth taking the whole request as JSON, rather than through headers.
+func VerifyAuthRequest(r *http.Request, log *logrus.Entry) interface{} {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("Failed to read body")
 	}
 
-	validKeys, err := keys.QueryRemoteKeys(models.ServerName(origin), 0)
+	descriptor := &CheckAuthRequest{}
+	err = json.Unmarshal(b, descriptor)
 	if err != nil {
-		log.Error(err)
-		return common.InternalServerError("Failed to get remote server keys")
+		log.Warn(err)
+		return common.BadRequest("Body not JSON")
 	}
 
-	publicKeys := map[string]map[string]ed25519.PublicKey{
-		string(validKeys.ServerName): {},
+	req, errResp := descriptor.toSignedRequest()
+	if errResp != nil {
+		return errResp
+	}
+
+	verified, err := keys.VerifyRequest(req)
+	if err != nil {
+		log.Warn(err)
+		return authErrorResponse(err)
 	}
-	for _, k := range validKeys.Keys {
-		b, err := signing.DecodeUnpaddedBase64String(string(k.PublicKey))
-		if err != nil {
-			log.Error(err)
-			return common.InternalServerError("Failed to parse remote server keys")
-		}
 
-		publicKeys[string(k.ServerName)][string(k.ID)] = ed25519.PublicKey(b)
+	return &CheckAuthResponse{
+		Verified: true,
+		Origin:   verified.Origin,
+		KeyID:    string(verified.KeyID),
 	}
+}
 
-	err = signing.VerifySignatures(obj, publicKeys)
+// VerifyAuthRequests is VerifyAuthRequest for many requests at once. Each origin's keys are
+// only fetched once, and every request gets its own result, in the order given.
+func VerifyAuthRequests(r *http.Request, log *logrus.Entry) interface{} {
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error(err)
-		return common.UnauthorizedError()
+		return common.InternalServerError("Failed to read body")
 	}
 
-	return common.EmptyResponse{}
+	batch := &BatchCheckAuthRequest{}
+	err = json.Unmarshal(b, batch)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Body not JSON")
+	}
+	if len(batch.Requests) > MaxCheckAuthBatchSize {
+		return common.BadRequest(fmt.Sprintf("At most %d requests can be checked at once", MaxCheckAuthBatchSize))
+	}
+
+	resp := &BatchCheckAuthResponse{Results: make([]*BatchCheckAuthResult, len(batch.Requests))}
+	reqs := make([]*keys.SignedRequest, 0, len(batch.Requests))
+	positions := make([]int, 0, len(batch.Requests))
+	for i, descriptor := range batch.Requests {
+		if descriptor == nil {
+			resp.Results[i] = &BatchCheckAuthResult{Error: common.BadRequest("Request is null")}
+			continue
+		}
+		req, errResp := descriptor.toSignedRequest()
+		if errResp != nil {
+			resp.Results[i] = &BatchCheckAuthResult{Error: errResp}
+			continue
+		}
+		reqs = append(reqs, req)
+		positions = append(positions, i)
+	}
+
+	verified, errs := keys.VerifyRequests(reqs)
+	for j, i := range positions {
+		if errs[j] != nil {
+			log.Warn(errs[j])
+			resp.Results[i] = &BatchCheckAuthResult{Error: authErrorResponse(errs[j])}
+			continue
+		}
+		resp.Results[i] = &BatchCheckAuthResult{
+			Verified: true,
+			Origin:   verified[j].Origin,
+			KeyID:    string(verified[j].KeyID),
+		}
+	}
+
+	return resp
+}
+
+func (d *CheckAuthRequest) toSignedRequest() (*keys.SignedRequest, *common.ErrorResponse) {
+	if d.Method == "" || d.Uri == "" {
+		return nil, common.BadRequest("method and uri are required")
+	}
+
+	req := &keys.SignedRequest{
+		Method:        d.Method,
+		Uri:           d.Uri,
+		Origin:        d.Origin,
+		Destination:   d.Destination,
+		Authorization: d.Authorization,
+		RequestTs:     models.Timestamp(d.RequestTs),
+	}
+	// The descriptor can't carry a body which isn't JSON, so null stands for no body
+	if string(d.Content) != "null" {
+		req.Content = d.Content
+	}
+	return req, nil
+}
+
+// authErrorResponse describes why a request failed verification. Failures to get the
+// origin's keys keep the status of the underlying problem, so they aren't mistaken for a
+// bad signature.
+func authErrorResponse(err error) *common.ErrorResponse {
+	authErr := &keys.AuthError{}
+	if !errors.As(err, &authErr) {
+		return common.InternalServerError("Failed to verify request")
+	}
+
+	resp := &common.ErrorResponse{
+		Code:       "M_UNAUTHORIZED",
+		Message:    authErr.Err.Error(),
+		HttpStatus: http.StatusUnauthorized,
+		Reason:     authErr.Reason,
+	}
+	switch authErr.Reason {
+	case keys.AuthReasonServerDenied:
+		resp.Code = "M_FORBIDDEN"
+		resp.HttpStatus = http.StatusForbidden
+	case keys.AuthReasonReplayCheckFailed:
+		resp.Code = "M_UNKNOWN"
+		resp.Message = "Failed to check for a replayed request"
+		resp.HttpStatus = http.StatusInternalServerError
+	case keys.AuthReasonKeysUnavailable:
+		remote := common.RemoteServerError(authErr.Err, "")
+		resp.Code = remote.Code
+		resp.HttpStatus = remote.HttpStatus
+		if kind := federation.Classify(authErr.Err); kind != federation.ErrorKindUnknown {
+			resp.Message = "Failed to get keys for the origin (" + string(kind) + "): " + authErr.Err.Error()
+		} else {
+			resp.Message = "Failed to get keys for the origin"
+		}
+	}
+	return resp
 }
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys_v2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+// NotaryCacheEnabled reuses signed notary responses until the remote server's keys change or
+// this server's keys rotate.
+var NotaryCacheEnabled = true
+
+// NotaryCacheUseDatabase additionally stores signed notary responses in the database so they
+// can be shared between key server processes.
+var NotaryCacheUseDatabase = false
+
+type cachedNotaryResponse struct {
+	fingerprint string
+	response    map[string]interface{}
+}
+
+var notaryResponseCache = cache.New(1*time.Hour, 2*time.Hour)
+
+// notaryFingerprint identifies the inputs to a signed notary response: the remote server's
+// cached data and our own keys. A change to either invalidates cached responses.
+func notaryFingerprint(remoteKeys *models.CachedRemoteKeys, ownKeys []*models.OwnKey) string {
+	parts := []string{fmt.Sprintf("remote|%s|%d|%d", remoteKeys.ServerName, remoteKeys.UpdatedTs, remoteKeys.ValidUntilTs)}
+	for _, k := range ownKeys {
+		parts = append(parts, fmt.Sprintf("self|%s|%s|%d", k.ID, k.PublicKey, k.ExpiresTs))
+	}
+	sort.Strings(parts)
+
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getCachedNotaryResponse returns a copy of the cached response for a server, if it was made
+// from the same inputs. Callers may change the copy freely.
+func getCachedNotaryResponse(serverName string, fingerprint string, log *logrus.Entry) map[string]interface{} {
+	if !NotaryCacheEnabled {
+		return nil
+	}
+
+	if record, found := notaryResponseCache.Get(serverName); found {
+		cached := record.(*cachedNotaryResponse)
+		if cached.fingerprint == fingerprint {
+			return copyNotaryResponse(cached.response, log)
+		}
+		notaryResponseCache.Delete(serverName)
+	}
+
+	if NotaryCacheUseDatabase {
+		dbFingerprint, response, err := db.GetNotaryResponse(models.ServerName(serverName))
+		if err != nil {
+			// Not fatal: we can always sign a fresh response
+			log.Warn("Failed to read cached notary response: ", err)
+			return nil
+		}
+		if response != nil && dbFingerprint == fingerprint {
+			notaryResponseCache.Set(serverName, &cachedNotaryResponse{fingerprint, response}, cache.DefaultExpiration)
+			return copyNotaryResponse(response, log)
+		}
+	}
+
+	return nil
+}
+
+func cacheNotaryResponse(serverName string, fingerprint string, response map[string]interface{}, log *logrus.Entry) {
+	if !NotaryCacheEnabled {
+		return
+	}
+
+	// The caller keeps using its response, so the cache needs its own
+	cached := copyNotaryResponse(response, log)
+	if cached == nil {
+		return
+	}
+	notaryResponseCache.Set(serverName, &cachedNotaryResponse{fingerprint, cached}, cache.DefaultExpiration)
+
+	if NotaryCacheUseDatabase {
+		err := db.UpsertNotaryResponse(models.ServerName(serverName), fingerprint, response, models.Timestamp(util.NowMillis()))
+		if err != nil {
+			log.Warn("Failed to store cached notary response: ", err)
+		}
+	}
+}
+
+func copyNotaryResponse(response map[string]interface{}, log *logrus.Entry) map[string]interface{} {
+	m, err := util.InterfaceToMap(response)
+	if err != nil {
+		log.Warn("Failed to copy notary response: ", err)
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys_v2
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/db/models"
+)
+
+func TestNotaryResponseCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	notaryResponseCache.Flush()
+	defer notaryResponseCache.Flush()
+
+	if r := getCachedNotaryResponse("example.org", "fp1", log); r != nil {
+		t.Fatalf("Expected a miss on an empty cache, got %v", r)
+	}
+
+	response := map[string]interface{}{
+		"server_name": "example.org",
+		"signatures":  map[string]interface{}{"example.org": map[string]interface{}{"ed25519:a": "sig"}},
+	}
+	cacheNotaryResponse("example.org", "fp1", response, log)
+
+	// The cache must not share the caller's map
+	response["server_name"] = "changed.example.org"
+
+	hit := getCachedNotaryResponse("example.org", "fp1", log)
+	if hit == nil {
+		t.Fatal("Expected a hit for the same fingerprint")
+	}
+	if hit["server_name"] != "example.org" {
+		t.Errorf("Expected the cached response to be unaffected by the caller, got %v", hit["server_name"])
+	}
+
+	// Nor should callers changing a hit affect later hits
+	hit["signatures"].(map[string]interface{})["example.org"].(map[string]interface{})["ed25519:b"] = "other"
+	again := getCachedNotaryResponse("example.org", "fp1", log)
+	if len(again["signatures"].(map[string]interface{})["example.org"].(map[string]interface{})) != 1 {
+		t.Errorf("Expected the cached response to be unaffected by a previous hit, got %v", again["signatures"])
+	}
+
+	if r := getCachedNotaryResponse("example.org", "fp2", log); r != nil {
+		t.Errorf("Expected a changed fingerprint to miss, got %v", r)
+	}
+	if r := getCachedNotaryResponse("example.org", "fp1", log); r != nil {
+		t.Errorf("Expected the stale response to have been dropped, got %v", r)
+	}
+}
+
+func TestNotaryFingerprint(t *testing.T) {
+	remote := &models.CachedRemoteKeys{
+		RemoteServer: &models.RemoteServer{ServerName: "example.org", UpdatedTs: 1000, ValidUntilTs: 2000},
+	}
+	own := []*models.OwnKey{{ID: "ed25519:a", PublicKey: "AAAA"}}
+	base := notaryFingerprint(remote, own)
+
+	if base != notaryFingerprint(remote, own) {
+		t.Error("Expected the fingerprint to be stable")
+	}
+
+	refreshed := &models.CachedRemoteKeys{
+		RemoteServer: &models.RemoteServer{ServerName: "example.org", UpdatedTs: 1500, ValidUntilTs: 2000},
+	}
+	if base == notaryFingerprint(refreshed, own) {
+		t.Error("Expected a remote refresh to change the fingerprint")
+	}
+
+	rotated := []*models.OwnKey{{ID: "ed25519:a", PublicKey: "AAAA", ExpiresTs: 1200}, {ID: "ed25519:b", PublicKey: "BBBB"}}
+	if base == notaryFingerprint(remote, rotated) {
+		t.Error("Expected a key rotation to change the fingerprint")
+	}
+}
@@ -18,6 +18,7 @@ package keys_v2
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -28,6 +29,7 @@ import (
 	"github.com/t2bot/matrix-key-server/api/common"
 	"github.com/t2bot/matrix-key-server/db"
 	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
 	"github.com/t2bot/matrix-key-server/keys"
 	"github.com/t2bot/matrix-key-server/signing"
 	"github.com/t2bot/matrix-key-server/util"
@@ -63,6 +65,18 @@ func QueryKeysSingle(r *http.Request, log *logrus.Entry) interface{} {
 		}
 	}
 
+	err = federation.ValidateServerName(serverName)
+	if err != nil {
+		log.Warn(err)
+		return common.BadRequest("Invalid server name")
+	}
+
+	err = federation.CheckServerAllowed(serverName)
+	if err != nil {
+		log.Warn(err)
+		return common.Forbidden("Server not allowed")
+	}
+
 	expanded, errLike := findAndPrepareKeys(serverName, minValidTs, log)
 	if errLike != nil {
 		return errLike
@@ -88,6 +102,16 @@ func QueryKeysBatch(r *http.Request, log *logrus.Entry) interface{} {
 	finalResp := &BatchedServerKeys{Keys: make([]map[string]interface{}, 0)}
 
 	for domain, keySearches := range lookup.Keys {
+		err = federation.ValidateServerName(domain)
+		if err == nil {
+			err = federation.CheckServerAllowed(domain)
+		}
+		if err != nil {
+			// Skip the server rather than failing the whole batch
+			log.Warn(err)
+			continue
+		}
+
 		maxMinValidTs := int64(0)
 		for _, q := range keySearches {
 			if q.MinValidTs > maxMinValidTs {
@@ -101,6 +125,11 @@ func QueryKeysBatch(r *http.Request, log *logrus.Entry) interface{} {
 
 		expanded, errLike := findAndPrepareKeys(domain, maxMinValidTs, log)
 		if errLike != nil {
+			// A remote server failing shouldn't fail the whole batch, but a problem on our
+			// side should
+			if e, ok := errLike.(*common.ErrorResponse); ok && e.Reason != "" {
+				continue
+			}
 			return errLike
 		}
 
@@ -113,8 +142,8 @@ func QueryKeysBatch(r *http.Request, log *logrus.Entry) interface{} {
 func findAndPrepareKeys(serverName string, minValidTs int64, log *logrus.Entry) (map[string]interface{}, interface{}) {
 	remoteKeys, err := keys.QueryRemoteKeys(models.ServerName(serverName), models.Timestamp(minValidTs))
 	if err != nil {
-		log.Error(err)
-		return nil, common.InternalServerError("Fatal error retrieving keys")
+		log.WithField("reason", federation.Classify(err)).Error(err)
+		return nil, common.RemoteServerError(err, "Failed to retrieve keys from "+serverName)
 	}
 	if len(remoteKeys.Keys) == 0 {
 		log.Warn("Did not get any keys from remote server")
@@ -122,8 +151,21 @@ func findAndPrepareKeys(serverName string, minValidTs int64, log *logrus.Entry)
 	}
 
 	if string(remoteKeys.ServerName) != serverName {
-		log.Error("Got response from unexpected server")
-		return nil, common.InternalServerError("Unexpected server_name")
+		err = &federation.InvalidResponseError{Err: fmt.Errorf("expected server_name %s, got %s", serverName, remoteKeys.ServerName)}
+		log.WithField("reason", federation.Classify(err)).Error(err)
+		return nil, common.RemoteServerError(err, "Unexpected server_name")
+	}
+
+	ownKeys, err := db.GetAllOwnKeys()
+	if err != nil {
+		log.Error(err)
+		return nil, common.InternalServerError("Failed to get own keys")
+	}
+
+	// Signing is expensive, so reuse an earlier response if nothing has changed since
+	fingerprint := notaryFingerprint(remoteKeys, ownKeys)
+	if cached := getCachedNotaryResponse(serverName, fingerprint, log); cached != nil {
+		return cached, nil
 	}
 
 	publicKeys := map[string]map[string]ed25519.PublicKey{
@@ -176,12 +218,6 @@ func findAndPrepareKeys(serverName string, minValidTs int64, log *logrus.Entry)
 		}
 	}
 
-	ownKeys, err := db.GetAllOwnKeys()
-	if err != nil {
-		log.Error(err)
-		return nil, common.InternalServerError("Failed to get own keys")
-	}
-
 	for _, key := range ownKeys {
 		loaded, err := keys.LoadKey(key)
 		if err != nil {
@@ -213,5 +249,6 @@ func findAndPrepareKeys(serverName string, minValidTs int64, log *logrus.Entry)
 		return nil, common.InternalServerError("Failed last-minute signature verifications")
 	}
 
+	cacheNotaryResponse(serverName, fingerprint, expanded, log)
 	return expanded, nil
 }
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys_v2
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/api/common"
+)
+
+func TestQueryKeys_InvalidServerNames(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	for _, serverName := range []string{"a:b:c", "[::1", "foo:"} {
+		r, _ := http.NewRequest("GET", "/_matrix/key/v2/query/"+serverName, nil)
+		r = mux.SetURLVars(r, map[string]string{"serverName": serverName})
+		errResp, ok := QueryKeysSingle(r, log).(*common.ErrorResponse)
+		if !ok || errResp.HttpStatus != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400, got %+v", serverName, errResp)
+		}
+	}
+
+	body := `{"server_keys":{"a:b:c":{},"[::1":{},"foo:":{}}}`
+	r, _ := http.NewRequest("POST", "/_matrix/key/v2/query", bytes.NewBufferString(body))
+	res, ok := QueryKeysBatch(r, log).(*BatchedServerKeys)
+	if !ok {
+		t.Fatalf("Expected the invalid server names to be skipped, got %+v", res)
+	}
+	if len(res.Keys) != 0 {
+		t.Errorf("Expected no keys, got %+v", res.Keys)
+	}
+}
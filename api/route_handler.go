@@ -46,6 +46,16 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res = &common.EmptyResponse{}
 	}
 
+	if result, ok := res.(*common.HeadersResponse); ok {
+		for k, v := range result.Headers {
+			w.Header()[k] = v
+		}
+		res = result.Body
+		if res == nil {
+			res = &common.EmptyResponse{}
+		}
+	}
+
 	contextLog.Info(fmt.Sprintf("Replying with result: %T %+v", res, res))
 
 	statusCode := http.StatusOK
@@ -42,6 +42,14 @@ func Run(listenHost string, listenPort int) {
 	querySingleHandler := handler{keys_v2.QueryKeysSingle, "query_keys_single"}
 	queryBatchHandler := handler{keys_v2.QueryKeysBatch, "query_keys_batch"}
 	verifyAuthHandler := handler{custom.VerifyAuthHeader, "verify_auth_header"}
+	verifyAuthV2Handler := handler{custom.VerifyAuthRequest, "verify_auth_request"}
+	verifyAuthBatchHandler := handler{custom.VerifyAuthRequests, "verify_auth_requests"}
+	diagnosticsHandler := handler{custom.ServerDiagnostics, "server_diagnostics"}
+	janitorHandler := handler{custom.JanitorDiagnostics, "janitor_diagnostics"}
+	testerHandler := handler{custom.FederationTester, "federation_tester"}
+	forwardAuthHandler := handler{custom.ForwardAuth, "forward_auth"}
+	verifyEventHandler := handler{custom.VerifyEvent, "verify_event"}
+	signHandler := handler{custom.SignAsSelf, "sign_as_self"}
 
 	routes := make(map[string]route)
 	routes["/_matrix/federation/v1/version"] = route{"GET", versionHandler}
@@ -51,6 +59,13 @@ func Run(listenHost string, listenPort int) {
 	routes["/_matrix/key/v2/query/{serverName:[^/]+}/{keyId:[^/]+}"] = route{"GET", querySingleHandler}
 	routes["/_matrix/key/v2/query"] = route{"POST", queryBatchHandler}
 	routes["/_matrix/key/unstable/check_auth"] = route{"POST", verifyAuthHandler}
+	routes["/_matrix/key/unstable/v2/check_auth"] = route{"POST", verifyAuthV2Handler}
+	routes["/_matrix/key/unstable/v2/check_auth/batch"] = route{"POST", verifyAuthBatchHandler}
+	routes["/_matrix/key/unstable/verify_event"] = route{"POST", verifyEventHandler}
+	routes["/_matrix/key/unstable/sign"] = route{"POST", signHandler}
+	routes["/_matrix/key/unstable/diagnostics/{serverName:[^/]+}"] = route{"GET", diagnosticsHandler}
+	routes["/_matrix/key/unstable/janitor"] = route{"GET", janitorHandler}
+	routes["/_matrix/key/unstable/federation_tester/{serverName:[^/]+}"] = route{"GET", testerHandler}
 
 	for routePath, route := range routes {
 		logrus.Info("Registering route: " + route.method + " " + routePath)
@@ -61,6 +76,9 @@ func Run(listenHost string, listenPort int) {
 	}
 
 	rtr.Handle("/healthz", healthzHandler).Methods("OPTIONS", "GET")
+
+	// Proxies may make auth requests with the original request's method
+	rtr.Handle("/_matrix/key/unstable/forward_auth", forwardAuthHandler)
 	rtr.NotFoundHandler = handler{NotFoundHandler, "not_found"}
 	rtr.MethodNotAllowedHandler = handler{MethodNotAllowedHandler, "method_not_allowed"}
 
@@ -31,7 +31,7 @@ type Database struct {
 var dbInstance *Database
 
 func Setup(dbUrl string) error {
-	dbInstance := &Database{}
+	dbInstance = &Database{}
 	var err error
 
 	if dbInstance.db, err = sql.Open("postgres", dbUrl); err != nil {
@@ -45,6 +45,12 @@ func Setup(dbUrl string) error {
 	fnCalls = append(fnCalls, func() error { return prepareMigrations(dbInstance.db) })
 	fnCalls = append(fnCalls, func() error { return applyMigration(dbInstance.db, migrations.Up20190727160045AddKeyTables) })
 	fnCalls = append(fnCalls, func() error { return applyMigration(dbInstance.db, migrations.Up20190728135345AddRemoteKeyTables) })
+	fnCalls = append(fnCalls, func() error { return applyMigration(dbInstance.db, migrations.Up20261019120000AddNotaryResponseCache) })
+	fnCalls = append(fnCalls, func() error {
+		return applyMigration(dbInstance.db, migrations.Up20261019130000AddRemoteServerLastRequested)
+	})
+	fnCalls = append(fnCalls, func() error { return applyMigration(dbInstance.db, migrations.Up20261019140000AddSeenSignatures) })
+	fnCalls = append(fnCalls, func() error { return applyMigration(dbInstance.db, migrations.Up20261019150000AddSigningAudit) })
 	fnCalls = append(fnCalls, func() error { return prepareStatements(dbInstance.db) })
 
 	for _, fn := range fnCalls {
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrations
+
+import (
+	"database/sql"
+)
+
+func Up20261019120000AddNotaryResponseCache(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec("CREATE TABLE notary_responses (server_name VARCHAR(255) NOT NULL, fingerprint VARCHAR(255) NOT NULL, response_json JSON NOT NULL, created_ts BIGINT NOT NULL, PRIMARY KEY (server_name));")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrations
+
+import (
+	"database/sql"
+)
+
+func Up20261019130000AddRemoteServerLastRequested(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec("ALTER TABLE remote_servers ADD COLUMN last_requested_ts BIGINT NOT NULL DEFAULT 0;")
+	if err != nil {
+		return err
+	}
+
+	// Treat the last refresh as the last request so existing servers aren't pruned straight away
+	_, err = db.Exec("UPDATE remote_servers SET last_requested_ts = updated_ts;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package migrations
+
+import (
+	"database/sql"
+)
+
+func Up20261019150000AddSigningAudit(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec("CREATE TABLE signing_audit (id BIGSERIAL PRIMARY KEY, created_ts BIGINT NOT NULL, caller VARCHAR(255) NOT NULL, remote_addr VARCHAR(255) NOT NULL, kind VARCHAR(32) NOT NULL, room_version VARCHAR(32) NOT NULL, object_sha256 VARCHAR(255) NOT NULL, key_id VARCHAR(255) NOT NULL, outcome VARCHAR(32) NOT NULL, error TEXT NOT NULL);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -34,6 +34,7 @@ type RemoteServer struct {
 	UpdatedTs       Timestamp
 	ValidUntilTs    Timestamp
 	NonStandardJSON AdditionalJSON
+	LastRequestedTs Timestamp
 }
 
 type RemoteKey struct {
@@ -54,3 +55,16 @@ type CachedRemoteKeys struct {
 	Signatures []*RemoteSignature
 	Keys       []*RemoteKey
 }
+
+type SigningAuditRecord struct {
+	ID           int64
+	CreatedTs    Timestamp
+	Caller       string
+	RemoteAddr   string
+	Kind         string
+	RoomVersion  string
+	ObjectSha256 UnpaddedBase64EncodedData
+	KeyID        KeyID
+	Outcome      string
+	Error        string
+}
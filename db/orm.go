@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"encoding/json"
 
+	"github.com/lib/pq"
 	"github.com/t2bot/matrix-key-server/db/models"
 )
 
@@ -97,7 +98,7 @@ func GetRemoteServerMetadata(serverName models.ServerName) (*models.RemoteServer
 	var server = &models.RemoteServer{ServerName: serverName}
 	var jsonOut string
 
-	err := r.Scan(&server.UpdatedTs, &server.ValidUntilTs, &jsonOut)
+	err := r.Scan(&server.UpdatedTs, &server.ValidUntilTs, &jsonOut, &server.LastRequestedTs)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -127,6 +128,113 @@ func UpsertRemoteServer(serverName models.ServerName, updatedTs models.Timestamp
 	return nil
 }
 
+func MarkRemoteServerRequested(serverName models.ServerName, requestedTs models.Timestamp) error {
+	_, err := statements[updateRemoteServerLastRequested].Exec(serverName, requestedTs)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func GetUnusedRemoteServers(cutoffTs models.Timestamp, pinned []models.ServerName) ([]models.ServerName, error) {
+	pinnedNames := make([]string, 0, len(pinned))
+	for _, n := range pinned {
+		pinnedNames = append(pinnedNames, string(n))
+	}
+
+	r, err := statements[selectUnusedRemoteServers].Query(cutoffTs, pq.Array(pinnedNames))
+	if err == sql.ErrNoRows {
+		return make([]models.ServerName, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	results := make([]models.ServerName, 0)
+	for r.Next() {
+		var v models.ServerName
+		err = r.Scan(&v)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+
+	return results, r.Err()
+}
+
+// DeleteRemoteServer removes everything cached for a remote server, returning the number of
+// keys, signatures, and notary responses removed alongside it.
+func DeleteRemoteServer(serverName models.ServerName) (int64, int64, int64, error) {
+	tx, err := dbInstance.db.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer tx.Rollback()
+
+	counts := make([]int64, 0, 4)
+	for _, stmt := range []string{deleteRemoteKeys, deleteRemoteSignatures, deleteNotaryResponses, deleteRemoteServer} {
+		res, err := tx.Stmt(statements[stmt]).Exec(serverName)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		counts = append(counts, affected)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return counts[0], counts[1], counts[2], nil
+}
+
+func DeleteNotaryResponsesBefore(cutoffTs models.Timestamp) (int64, error) {
+	res, err := statements[deleteNotaryResponsesBefore].Exec(cutoffTs)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MarkSignatureSeen records a signature as used until expiresTs, returning false if it was
+// already recorded and hasn't expired by nowTs.
+func MarkSignatureSeen(origin string, signature string, expiresTs models.Timestamp, nowTs models.Timestamp) (bool, error) {
+	res, err := statements[upsertSeenSignature].Exec(origin, signature, expiresTs, nowTs)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func DeleteSeenSignaturesBefore(cutoffTs models.Timestamp) (int64, error) {
+	res, err := statements[deleteSeenSignaturesBefore].Exec(cutoffTs)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AddSigningAuditRecord stores a record of a signing operation, returning its ID.
+func AddSigningAuditRecord(record *models.SigningAuditRecord) (int64, error) {
+	r := statements[insertSigningAuditRecord].QueryRow(record.CreatedTs, record.Caller, record.RemoteAddr, record.Kind, record.RoomVersion, record.ObjectSha256, record.KeyID, record.Outcome, record.Error)
+	var id int64
+	err := r.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
 func DeleteRemoteServerKeys(serverName models.ServerName) error {
 	_, err := statements[deleteRemoteKeys].Exec(serverName)
 	if err != nil {
@@ -202,3 +310,38 @@ func GetAllRemoteServerSignatures(serverName models.ServerName) ([]*models.Remot
 
 	return results, nil
 }
+
+func GetNotaryResponse(serverName models.ServerName) (string, map[string]interface{}, error) {
+	r := statements[selectNotaryResponse].QueryRow(serverName)
+
+	var fingerprint string
+	var jsonOut string
+
+	err := r.Scan(&fingerprint, &jsonOut)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	response := make(map[string]interface{})
+	err = json.Unmarshal([]byte(jsonOut), &response)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return fingerprint, response, nil
+}
+
+func UpsertNotaryResponse(serverName models.ServerName, fingerprint string, response map[string]interface{}, createdTs models.Timestamp) error {
+	j, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = statements[upsertNotaryResponse].Exec(serverName, fingerprint, string(j), createdTs)
+	if err != nil {
+		return err
+	}
+	return nil
+}
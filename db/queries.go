@@ -34,18 +34,38 @@ const deleteRemoteSignatures = "deleteRemoteSignatures"
 const upsertRemoteServer = "upsertRemoteServer"
 const insertRemoteKey = "insertRemoteKey"
 const insertRemoteSignature = "insertRemoteSignature"
+const selectNotaryResponse = "selectNotaryResponse"
+const upsertNotaryResponse = "upsertNotaryResponse"
+const updateRemoteServerLastRequested = "updateRemoteServerLastRequested"
+const selectUnusedRemoteServers = "selectUnusedRemoteServers"
+const deleteRemoteServer = "deleteRemoteServer"
+const deleteNotaryResponses = "deleteNotaryResponses"
+const deleteNotaryResponsesBefore = "deleteNotaryResponsesBefore"
+const upsertSeenSignature = "upsertSeenSignature"
+const deleteSeenSignaturesBefore = "deleteSeenSignaturesBefore"
+const insertSigningAuditRecord = "insertSigningAuditRecord"
 
 var queries = map[string]string{
-	selectAllSelfKeys:      "SELECT key_id, public_key_b64, private_key_b64, expires_ts FROM self_keys;",
-	selectActiveSelfKeyIds: "SELECT key_id FROM self_keys WHERE expires_ts = 0;",
-	selectSelfKey:          "SELECT public_key_b64, private_key_b64, expires_ts FROM self_keys WHERE key_id = $1;",
-	insertActiveSelfKey:    "INSERT INTO self_keys (key_id, public_key_b64, private_key_b64) VALUES ($1, $2, $3);",
-	selectRemoteServer:     "SELECT updated_ts, valid_until_ts, nonstandard_json FROM remote_servers WHERE server_name = $1",
-	selectRemoteKeys:       "SELECT key_id, public_key_b64, expires_ts FROM remote_keys WHERE server_name = $1",
-	selectRemoteSignatures: "SELECT key_id, signature_b64 FROM remote_signatures WHERE server_name = $1",
-	deleteRemoteKeys:       "DELETE FROM remote_keys WHERE server_name = $1;",
-	deleteRemoteSignatures: "DELETE FROM remote_signatures WHERE server_name = $1;",
-	upsertRemoteServer:     "INSERT INTO remote_servers (server_name, updated_ts, valid_until_ts, nonstandard_json) VALUES ($1, $2, $3, $4) ON CONFLICT (server_name) DO UPDATE SET updated_ts = $2, valid_until_ts = $3, nonstandard_json = $4;",
-	insertRemoteKey:        "INSERT INTO remote_keys (server_name, key_id, public_key_b64, expires_ts) VALUES ($1, $2, $3, $4);",
-	insertRemoteSignature:  "INSERT INTO remote_signatures (server_name, key_id, signature_b64) VALUES ($1, $2, $3);",
+	selectAllSelfKeys:               "SELECT key_id, public_key_b64, private_key_b64, expires_ts FROM self_keys;",
+	selectActiveSelfKeyIds:          "SELECT key_id FROM self_keys WHERE expires_ts = 0;",
+	selectSelfKey:                   "SELECT public_key_b64, private_key_b64, expires_ts FROM self_keys WHERE key_id = $1;",
+	insertActiveSelfKey:             "INSERT INTO self_keys (key_id, public_key_b64, private_key_b64) VALUES ($1, $2, $3);",
+	selectRemoteServer:              "SELECT updated_ts, valid_until_ts, nonstandard_json, last_requested_ts FROM remote_servers WHERE server_name = $1",
+	selectRemoteKeys:                "SELECT key_id, public_key_b64, expires_ts FROM remote_keys WHERE server_name = $1",
+	selectRemoteSignatures:          "SELECT key_id, signature_b64 FROM remote_signatures WHERE server_name = $1",
+	deleteRemoteKeys:                "DELETE FROM remote_keys WHERE server_name = $1;",
+	deleteRemoteSignatures:          "DELETE FROM remote_signatures WHERE server_name = $1;",
+	upsertRemoteServer:              "INSERT INTO remote_servers (server_name, updated_ts, valid_until_ts, nonstandard_json, last_requested_ts) VALUES ($1, $2, $3, $4, $2) ON CONFLICT (server_name) DO UPDATE SET updated_ts = $2, valid_until_ts = $3, nonstandard_json = $4, last_requested_ts = $2;",
+	insertRemoteKey:                 "INSERT INTO remote_keys (server_name, key_id, public_key_b64, expires_ts) VALUES ($1, $2, $3, $4);",
+	insertRemoteSignature:           "INSERT INTO remote_signatures (server_name, key_id, signature_b64) VALUES ($1, $2, $3);",
+	selectNotaryResponse:            "SELECT fingerprint, response_json FROM notary_responses WHERE server_name = $1;",
+	upsertNotaryResponse:            "INSERT INTO notary_responses (server_name, fingerprint, response_json, created_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (server_name) DO UPDATE SET fingerprint = $2, response_json = $3, created_ts = $4;",
+	updateRemoteServerLastRequested: "UPDATE remote_servers SET last_requested_ts = $2 WHERE server_name = $1;",
+	selectUnusedRemoteServers:       "SELECT server_name FROM remote_servers WHERE last_requested_ts < $1 AND updated_ts < $1 AND NOT (server_name = ANY($2));",
+	deleteRemoteServer:              "DELETE FROM remote_servers WHERE server_name = $1;",
+	deleteNotaryResponses:           "DELETE FROM notary_responses WHERE server_name = $1;",
+	deleteNotaryResponsesBefore:     "DELETE FROM notary_responses WHERE created_ts < $1;",
+	upsertSeenSignature:             "INSERT INTO seen_signatures (origin, signature_b64, expires_ts) VALUES ($1, $2, $3) ON CONFLICT (origin, signature_b64) DO UPDATE SET expires_ts = $3 WHERE seen_signatures.expires_ts < $4;",
+	deleteSeenSignaturesBefore:      "DELETE FROM seen_signatures WHERE expires_ts < $1;",
+	insertSigningAuditRecord:        "INSERT INTO signing_audit (created_ts, caller, remote_addr, kind, room_version, object_sha256, key_id, outcome, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;",
 }
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// HttpClient makes the HTTP requests needed for server discovery and federation. *http.Client
+// satisfies it.
+type HttpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// HttpClientFactory creates a client for federation requests which verifies the remote
+// certificate against the given server name rather than the address being connected to.
+type HttpClientFactory func(tlsServerName string) HttpClient
+
+// ClientPoolConfig controls the long-lived clients used for federation requests. Each TLS
+// server name gets its own client so connections (and their TLS sessions) are reused
+// across requests to the same server.
+type ClientPoolConfig struct {
+	DialTimeout           time.Duration
+	TlsHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	Http2                 bool
+
+	// How long a client may go unused before it is closed and dropped from the pool
+	UnusedClientTtl time.Duration
+}
+
+var DefaultClientPoolConfig = ClientPoolConfig{
+	DialTimeout:           10 * time.Second,
+	TlsHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 15 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   4,
+	Http2:                 true,
+	UnusedClientTtl:       1 * time.Hour,
+}
+
+type clientPool struct {
+	config  ClientPoolConfig
+	clients *cache.Cache
+	lock    sync.Mutex
+}
+
+var poolConfig = DefaultClientPoolConfig
+var federationClients = newClientPool(poolConfig)
+
+var wellKnownClient HttpClient = newWellKnownClient()
+var federationClientFactory HttpClientFactory = pooledFederationClient
+
+// Clients set by the caller are left alone when the resolver, proxy or pool config changes
+var customWellKnownClient = false
+
+// SetWellKnownClient replaces the client used for .well-known lookups. A nil client goes
+// back to the built-in one. A custom client is kept when the resolver, proxy or pool config
+// changes later, so it has to handle those itself.
+func SetWellKnownClient(c HttpClient) {
+	customWellKnownClient = c != nil
+	if c == nil {
+		c = newWellKnownClient()
+	}
+	wellKnownClient = c
+}
+
+// SetFederationClientFactory replaces how clients for federation requests are created. A nil
+// factory goes back to the built-in pool. As with SetWellKnownClient, a custom factory is
+// kept when the resolver, proxy or pool config changes later.
+func SetFederationClientFactory(f HttpClientFactory) {
+	if f == nil {
+		f = pooledFederationClient
+	}
+	federationClientFactory = f
+}
+
+// SetClientPoolConfig replaces the settings for federation clients. Clients already in the
+// pool are closed once their current requests finish.
+func SetClientPoolConfig(config ClientPoolConfig) {
+	poolConfig = config
+	resetHttpClients()
+}
+
+// resetHttpClients rebuilds the built-in clients after a setting they depend on has changed.
+func resetHttpClients() {
+	if !customWellKnownClient {
+		wellKnownClient = newWellKnownClient()
+	}
+
+	// The built-in factory reads from the pool, so replacing the pool is enough for it
+	old := federationClients
+	federationClients = newClientPool(poolConfig)
+	old.close()
+}
+
+func newWellKnownClient() HttpClient {
+	dialer := newGuardedDialer(10 * time.Second)
+	dialer.Resolver = netResolver()
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               proxyFunc(true),
+			DialContext:         proxyAwareDial(dialer),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: 15 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= wellKnownMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", wellKnownMaxRedirects)
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing to follow redirect to %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+func newClientPool(config ClientPoolConfig) *clientPool {
+	ttl := config.UnusedClientTtl
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	p := &clientPool{config: config, clients: cache.New(ttl, ttl)}
+	p.clients.OnEvicted(func(key string, value interface{}) {
+		value.(*http.Client).CloseIdleConnections()
+	})
+	return p
+}
+
+func pooledFederationClient(tlsServerName string) HttpClient {
+	return federationClients.get(tlsServerName)
+}
+
+func (p *clientPool) get(tlsServerName string) *http.Client {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var client *http.Client
+	if record, found := p.clients.Get(tlsServerName); found {
+		client = record.(*http.Client)
+	} else {
+		client = newFederationClient(tlsServerName, p.config)
+	}
+
+	// Setting the client again pushes back its expiry
+	p.clients.SetDefault(tlsServerName, client)
+	return client
+}
+
+func (p *clientPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, item := range p.clients.Items() {
+		item.Object.(*http.Client).CloseIdleConnections()
+	}
+	p.clients.Flush()
+}
+
+// This is how we verify the certificate is valid for the host we expect.
+// Previously using `req.URL.Host` we'd end up changing which server we were
+// connecting to (ie: matrix.org instead of matrix.org.cdn.cloudflare.net),
+// which obviously doesn't help us. We needed to do that though because the
+// HTTP client doesn't verify against the req.Host certificate, but it does
+// handle it off the req.URL.Host. So, we need to tell it which certificate
+// to verify.
+func newFederationClient(tlsServerName string, config ClientPoolConfig) *http.Client {
+	dialer := newGuardedDialer(config.DialTimeout)
+	dialer.Resolver = netResolver()
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:       proxyFunc(true),
+			DialContext: proxyAwareDial(dialer),
+			TLSClientConfig: &tls.Config{
+				ServerName: tlsServerName,
+			},
+			TLSHandshakeTimeout:   config.TlsHandshakeTimeout,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			IdleConnTimeout:       config.IdleConnTimeout,
+			MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+			// A custom dialer and TLS config disable HTTP/2 unless we ask for it
+			ForceAttemptHTTP2: config.Http2,
+		},
+	}
+}
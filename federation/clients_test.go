@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientPool_ReusesClients(t *testing.T) {
+	p := newClientPool(DefaultClientPoolConfig)
+
+	a := p.get("a.example.org")
+	if p.get("a.example.org") != a {
+		t.Error("Expected the same client for the same server name")
+	}
+	if p.get("b.example.org") == a {
+		t.Error("Expected a different client for a different server name")
+	}
+
+	tr := a.Transport.(*http.Transport)
+	if tr.TLSClientConfig.ServerName != "a.example.org" {
+		t.Errorf("Expected TLS server name a.example.org, got %s", tr.TLSClientConfig.ServerName)
+	}
+}
+
+func TestClientPool_AppliesConfig(t *testing.T) {
+	config := DefaultClientPoolConfig
+	config.ResponseHeaderTimeout = 3 * time.Second
+	config.IdleConnTimeout = 7 * time.Second
+	config.MaxIdleConnsPerHost = 9
+	config.Http2 = false
+	p := newClientPool(config)
+
+	tr := p.get("example.org").Transport.(*http.Transport)
+	if tr.ResponseHeaderTimeout != 3*time.Second {
+		t.Errorf("Expected a response header timeout of 3s, got %s", tr.ResponseHeaderTimeout)
+	}
+	if tr.IdleConnTimeout != 7*time.Second {
+		t.Errorf("Expected an idle connection timeout of 7s, got %s", tr.IdleConnTimeout)
+	}
+	if tr.MaxIdleConnsPerHost != 9 {
+		t.Errorf("Expected 9 idle connections per host, got %d", tr.MaxIdleConnsPerHost)
+	}
+	if tr.ForceAttemptHTTP2 {
+		t.Error("Expected HTTP/2 to be disabled")
+	}
+}
+
+func TestClientPool_DropsUnusedClients(t *testing.T) {
+	config := DefaultClientPoolConfig
+	config.UnusedClientTtl = 10 * time.Millisecond
+	p := newClientPool(config)
+
+	a := p.get("example.org")
+	time.Sleep(20 * time.Millisecond)
+	if p.get("example.org") == a {
+		t.Error("Expected the unused client to be replaced")
+	}
+}
+
+func TestResetHttpClients_KeepsCustomClients(t *testing.T) {
+	client := &fakeHttpClient{}
+	factory := func(tlsServerName string) HttpClient {
+		return client
+	}
+	SetWellKnownClient(client)
+	SetFederationClientFactory(factory)
+	t.Cleanup(func() {
+		SetWellKnownClient(nil)
+		SetFederationClientFactory(nil)
+	})
+
+	SetResolver(nil)
+	SetProxy(nil)
+	SetClientPoolConfig(DefaultClientPoolConfig)
+
+	if wellKnownClient != client {
+		t.Error("Expected the custom .well-known client to be kept")
+	}
+	if federationClientFactory("example.org") != client {
+		t.Error("Expected the custom federation client factory to be kept")
+	}
+}
+
+func TestResetHttpClients_RebuildsBuiltInClients(t *testing.T) {
+	SetWellKnownClient(nil)
+	SetFederationClientFactory(nil)
+
+	previousWellKnown := wellKnownClient
+	previousFederation := federationClientFactory("example.org")
+	SetResolver(nil)
+
+	if wellKnownClient == previousWellKnown {
+		t.Error("Expected the built-in .well-known client to be rebuilt")
+	}
+	if federationClientFactory("example.org") == previousFederation {
+		t.Error("Expected the built-in federation clients to be rebuilt")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Loopback, private, link-local, and otherwise reserved ranges. The key server is publicly
+// reachable and can be asked to contact arbitrary names, so we refuse to connect to these
+// unless an exception has been configured.
+var blockedRanges = mustParseCidrs([]string{
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // RFC1918
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local
+	"172.16.0.0/12",      // RFC1918
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.0.2.0/24",       // TEST-NET-1
+	"192.88.99.0/24",     // 6to4 relay anycast
+	"192.168.0.0/16",     // RFC1918
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // TEST-NET-2
+	"203.0.113.0/24",     // TEST-NET-3
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"64:ff9b::/96",       // NAT64
+	"100::/64",           // discard-only
+	"2001::/23",          // IETF protocol assignments
+	"2001:db8::/32",      // documentation
+	"fc00::/7",           // unique local
+	"fe80::/10",          // link-local
+	"ff00::/8",           // multicast
+})
+
+var allowedPrivateRanges = make([]*net.IPNet, 0)
+
+type BlockedAddressError struct {
+	Address string
+}
+
+func (e *BlockedAddressError) Error() string {
+	return fmt.Sprintf("refusing to connect to %s: address is in a private or reserved range", e.Address)
+}
+
+// SetAllowedPrivateRanges configures exceptions to the private and reserved ranges blocked
+// for outbound connections.
+func SetAllowedPrivateRanges(cidrs []string) error {
+	names, nets, err := parseAclRules(cidrs)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("expected IP addresses or CIDR ranges, got %s", names[0])
+	}
+	allowedPrivateRanges = nets
+	return nil
+}
+
+func isAddressAllowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if containsIp(allowedPrivateRanges, ip) {
+		return true
+	}
+	return !containsIp(blockedRanges, ip)
+}
+
+// checkDialedAddress refuses addresses in blocked ranges, and those in ranges denied by the
+// ServerAcl.
+func checkDialedAddress(address string, ip net.IP) error {
+	if !isAddressAllowed(ip) {
+		return &BlockedAddressError{Address: address}
+	}
+	if containsIp(serverAcl.denyNets, ip) {
+		return &ServerDeniedError{ServerName: address, Reason: "address is denied"}
+	}
+	return nil
+}
+
+// newGuardedDialer creates a dialer which refuses to connect to blocked or denied addresses.
+// The check happens after name resolution, so it also covers names which resolve to them.
+func newGuardedDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return &BlockedAddressError{Address: address}
+			}
+			return checkDialedAddress(address, ip)
+		},
+	}
+}
+
+func mustParseCidrs(cidrs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsAddressAllowed_Defaults(t *testing.T) {
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "0.0.0.0"}
+	for _, addr := range blocked {
+		if isAddressAllowed(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be blocked", addr)
+		}
+	}
+
+	allowed := []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111"}
+	for _, addr := range allowed {
+		if !isAddressAllowed(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be allowed", addr)
+		}
+	}
+}
+
+func TestIsAddressAllowed_Exceptions(t *testing.T) {
+	err := SetAllowedPrivateRanges([]string{"10.0.0.0/24", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetAllowedPrivateRanges(nil)
+
+	if !isAddressAllowed(net.ParseIP("10.0.0.5")) {
+		t.Error("Expected 10.0.0.5 to be allowed by exception")
+	}
+	if isAddressAllowed(net.ParseIP("10.0.1.5")) {
+		t.Error("Expected 10.0.1.5 to remain blocked")
+	}
+	if !isAddressAllowed(net.ParseIP("::1")) {
+		t.Error("Expected ::1 to be allowed by exception")
+	}
+
+	err = SetAllowedPrivateRanges([]string{"example.org"})
+	if err == nil {
+		t.Error("Expected an error for a non-address exception")
+	}
+}
+
+func TestCheckDialedAddress_DeniedRanges(t *testing.T) {
+	acl, err := NewServerAcl(nil, []string{"93.184.216.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetServerAcl(acl)
+	defer SetServerAcl(nil)
+
+	if err = checkDialedAddress("93.184.216.34:443", net.ParseIP("93.184.216.34")); err == nil {
+		t.Error("Expected 93.184.216.34 to be denied")
+	}
+	if err = checkDialedAddress("127.0.0.1:443", net.ParseIP("127.0.0.1")); err == nil {
+		t.Error("Expected 127.0.0.1 to be blocked")
+	}
+	if err = checkDialedAddress("1.1.1.1:443", net.ParseIP("1.1.1.1")); err != nil {
+		t.Errorf("Expected 1.1.1.1 to be allowed, got: %v", err)
+	}
+}
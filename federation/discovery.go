@@ -0,0 +1,369 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/is"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the steps recorded in a ResolvedServer's trace. These follow the server discovery
+// steps from the "Resolving server names" section of the server-server API specification.
+const (
+	StepParse        = "parse"
+	StepCache        = "cache"
+	StepIpLiteral    = "ip_literal"
+	StepExplicitPort = "explicit_port"
+	StepWellKnown    = "well_known"
+	StepSrvMatrixFed = "srv_matrix_fed"
+	StepSrvMatrix    = "srv_matrix"
+	StepFallback     = "fallback"
+)
+
+const defaultFederationPort = "8448"
+
+type TraceStep struct {
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Target struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+func (t Target) Url() string {
+	return "https://" + net.JoinHostPort(t.Host, t.Port)
+}
+
+// ResolvedServer is the outcome of server discovery: where to connect, in order of preference,
+// and what to present to whichever target answers.
+type ResolvedServer struct {
+	ServerName    string      `json:"server_name"`
+	HostHeader    string      `json:"host_header"`
+	TlsServerName string      `json:"tls_server_name"`
+	Targets       []Target    `json:"targets"`
+	Trace         []TraceStep `json:"trace"`
+	Cached        bool        `json:"cached"`
+
+	// The resolution can't outlive the .well-known response it was based on
+	wellKnownExpiresAt time.Time
+}
+
+const resolvedServerTtl = 1 * time.Hour
+
+var resolvedServerCache = cache.New(resolvedServerTtl, 2*time.Hour)
+
+// ResolveServer runs server discovery for a server name, reusing a recent result if there is one.
+func ResolveServer(serverName string) (*ResolvedServer, error) {
+	if record, found := resolvedServerCache.Get(serverName); found {
+		cached := *(record.(*ResolvedServer))
+		cached.Cached = true
+		cached.Trace = append(append(make([]TraceStep, 0), cached.Trace...), TraceStep{
+			Step:   StepCache,
+			Detail: "reused an earlier result",
+		})
+		return &cached, nil
+	}
+
+	res, err := ResolveServerUncached(serverName)
+	if err != nil {
+		return res, err
+	}
+
+	ttl := resolvedServerTtl
+	if !res.wellKnownExpiresAt.IsZero() && time.Until(res.wellKnownExpiresAt) < ttl {
+		ttl = time.Until(res.wellKnownExpiresAt)
+	}
+	// The .well-known response may have expired while we were resolving, and go-cache would
+	// keep a zero or negative ttl forever (or for the default ttl), so don't cache at all
+	if ttl > 0 {
+		resolvedServerCache.Set(serverName, res, ttl)
+	}
+	return res, nil
+}
+
+// GetCachedResolution returns the cached discovery result for a server name without resolving
+// it, or nil if there isn't one.
+func GetCachedResolution(serverName string) *ResolvedServer {
+	if record, found := resolvedServerCache.Get(serverName); found {
+		return record.(*ResolvedServer)
+	}
+	return nil
+}
+
+// ResolveServerUncached runs server discovery for a server name from scratch. The returned
+// trace describes each decision made along the way, even when an error is returned.
+func ResolveServerUncached(serverName string) (*ResolvedServer, error) {
+	res := &ResolvedServer{
+		ServerName: serverName,
+		Targets:    make([]Target, 0),
+		Trace:      make([]TraceStep, 0),
+	}
+
+	host, port, explicitPort, err := splitServerName(serverName)
+	if err != nil {
+		res.addStep(StepParse, err, "%s is not a valid server name", serverName)
+		return res, &InvalidServerNameError{ServerName: serverName, Err: err}
+	}
+
+	// Step 1: if the hostname is an IP literal, use that with the explicit or default port
+	if is.IP(host) {
+		res.HostHeader = serverName
+		res.TlsServerName = host
+		res.addTarget(host, port, 0, 0)
+		res.addStep(StepIpLiteral, nil, "%s is an IP literal: connecting to port %s", host, port)
+		return res, nil
+	}
+
+	// Step 2: if the hostname is not an IP literal and has an explicit port, use that
+	if explicitPort {
+		res.HostHeader = net.JoinHostPort(host, port)
+		res.TlsServerName = host
+		res.addTarget(host, port, 0, 0)
+		res.addStep(StepExplicitPort, nil, "%s has an explicit port: connecting to port %s", host, port)
+		return res, nil
+	}
+
+	// Step 3: if there's no explicit port, look for delegation through .well-known
+	wk := fetchWellKnown(host)
+	res.wellKnownExpiresAt = wk.ExpiresAt
+	cacheNote := ""
+	if wk.Cached {
+		cacheNote = fmt.Sprintf(" (cached until %s)", wk.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if wk.Err == nil {
+		delegated := wk.ServerAddr
+		dHost, dPort, dExplicitPort, err := splitServerName(delegated)
+		if err == nil {
+			res.addStep(StepWellKnown, nil, "%s delegates to %s%s", host, delegated, cacheNote)
+
+			// Step 3a: the delegated hostname is an IP literal
+			if is.IP(dHost) {
+				res.HostHeader = delegated
+				res.TlsServerName = dHost
+				res.addTarget(dHost, dPort, 0, 0)
+				res.addStep(StepIpLiteral, nil, "%s is an IP literal: connecting to port %s", dHost, dPort)
+				return res, nil
+			}
+
+			// Step 3b: the delegated hostname has an explicit port
+			if dExplicitPort {
+				res.HostHeader = net.JoinHostPort(dHost, dPort)
+				res.TlsServerName = dHost
+				res.addTarget(dHost, dPort, 0, 0)
+				res.addStep(StepExplicitPort, nil, "%s has an explicit port: connecting to port %s", dHost, dPort)
+				return res, nil
+			}
+
+			// Steps 3c through 3e: SRV records for the delegated hostname, then the hostname itself
+			res.resolveHostname(dHost)
+			return res, nil
+		}
+		res.addStep(StepWellKnown, err, "%s delegates to %s, which is not a valid server name%s", host, delegated, cacheNote)
+	} else {
+		res.addStep(StepWellKnown, wk.Err, "%s has no usable .well-known delegation%s", host, cacheNote)
+	}
+
+	// Steps 4 through 6: SRV records for the hostname, then the hostname itself
+	res.resolveHostname(host)
+	return res, nil
+}
+
+// resolveHostname finishes discovery for a hostname without an explicit port: SRV records
+// are preferred, falling back to the hostname on the default port.
+func (r *ResolvedServer) resolveHostname(host string) {
+	r.HostHeader = host
+	r.TlsServerName = host
+
+	services := []struct {
+		step    string
+		service string
+	}{
+		{StepSrvMatrixFed, "matrix-fed"},
+		{StepSrvMatrix, "matrix"}, // deprecated, but still in use
+	}
+	for _, s := range services {
+		name := fmt.Sprintf("_%s._tcp.%s", s.service, host)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, addrs, err := dnsResolver.LookupSRV(ctx, s.service, "tcp", host)
+		cancel()
+		if err != nil {
+			r.addStep(s.step, err, "no usable SRV records at %s", name)
+			continue
+		}
+
+		for _, addr := range orderSrvRecords(addrs) {
+			// Trim off the trailing period if there is one (golang doesn't like this)
+			target := strings.TrimSuffix(addr.Target, ".")
+			if target == "" {
+				// A target of "." means the service is decidedly not available
+				continue
+			}
+			r.addTarget(target, strconv.Itoa(int(addr.Port)), addr.Priority, addr.Weight)
+		}
+		if len(r.Targets) == 0 {
+			r.addStep(s.step, nil, "no usable SRV records at %s", name)
+			continue
+		}
+
+		r.addStep(s.step, nil, "found %d target(s) at %s", len(r.Targets), name)
+		return
+	}
+
+	r.addTarget(host, defaultFederationPort, 0, 0)
+	r.addStep(StepFallback, nil, "connecting to %s on the default port %s", host, defaultFederationPort)
+}
+
+func (r *ResolvedServer) addTarget(host string, port string, priority uint16, weight uint16) {
+	r.Targets = append(r.Targets, Target{
+		Host:     host,
+		Port:     port,
+		Priority: priority,
+		Weight:   weight,
+	})
+}
+
+func (r *ResolvedServer) addStep(step string, err error, format string, args ...interface{}) {
+	s := TraceStep{Step: step, Detail: fmt.Sprintf(format, args...)}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Trace = append(r.Trace, s)
+	logrus.Debugf("Resolving %s: [%s] %s %s", r.ServerName, s.Step, s.Detail, s.Error)
+}
+
+// InvalidServerNameError is returned for server names which can't be parsed, before anything is
+// looked up or contacted.
+type InvalidServerNameError struct {
+	ServerName string
+	Err        error
+}
+
+func (e *InvalidServerNameError) Error() string {
+	return fmt.Sprintf("%q is not a valid server name: %v", e.ServerName, e.Err)
+}
+
+func (e *InvalidServerNameError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateServerName returns an *InvalidServerNameError if a server name can't be resolved
+// because it isn't a hostname or IP literal with an optional port.
+func ValidateServerName(serverName string) error {
+	_, _, _, err := splitServerName(serverName)
+	if err != nil {
+		return &InvalidServerNameError{ServerName: serverName, Err: err}
+	}
+	return nil
+}
+
+// splitServerName splits a server name into its hostname and port, using the default
+// federation port if there isn't an explicit one.
+func splitServerName(serverName string) (string, string, bool, error) {
+	host, port, err := net.SplitHostPort(serverName)
+	if err != nil && strings.HasSuffix(err.Error(), "missing port in address") {
+		host, port, err = net.SplitHostPort(serverName + ":" + defaultFederationPort)
+		if err != nil {
+			return "", "", false, err
+		}
+		return host, port, false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	if host == "" {
+		return "", "", false, errors.New("missing hostname")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 || strings.Trim(port, "0123456789") != "" {
+		return "", "", false, fmt.Errorf("invalid port %q", port)
+	}
+	return host, port, true, nil
+}
+
+// orderSrvRecords sorts SRV records by priority, then shuffles records of equal priority
+// according to their weights as described by RFC 2782.
+func orderSrvRecords(records []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		ordered = append(ordered, weightedShuffle(sorted[i:j])...)
+		i = j
+	}
+
+	return ordered
+}
+
+func weightedShuffle(records []*net.SRV) []*net.SRV {
+	remaining := make([]*net.SRV, len(records))
+	copy(remaining, records)
+
+	// Zero-weight records go first so they still have a small chance of being picked,
+	// per RFC 2782.
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].Weight == 0 && remaining[j].Weight != 0
+	})
+
+	shuffled := make([]*net.SRV, 0, len(remaining))
+	for len(remaining) > 0 {
+		total := 0
+		for _, r := range remaining {
+			total += int(r.Weight)
+		}
+
+		pick := 0
+		if total > 0 {
+			n := rand.Intn(total + 1)
+			sum := 0
+			for i, r := range remaining {
+				sum += int(r.Weight)
+				if sum >= n {
+					pick = i
+					break
+				}
+			}
+		}
+
+		shuffled = append(shuffled, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+
+	return shuffled
+}
@@ -0,0 +1,381 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitServerName(t *testing.T) {
+	cases := []struct {
+		serverName   string
+		host         string
+		port         string
+		explicitPort bool
+		err          bool
+	}{
+		{"example.org", "example.org", "8448", false, false},
+		{"example.org:443", "example.org", "443", true, false},
+		{"1.2.3.4", "1.2.3.4", "8448", false, false},
+		{"1.2.3.4:1234", "1.2.3.4", "1234", true, false},
+		{"[::1]", "::1", "8448", false, false},
+		{"[::1]:8080", "::1", "8080", true, false},
+		{":8448", "", "", false, true},
+		{"a:b:c", "", "", false, true},
+		{"foo:", "", "", false, true},
+		{"foo:abc", "", "", false, true},
+		{"foo:0", "", "", false, true},
+		{"foo:65536", "", "", false, true},
+		{"foo:+443", "", "", false, true},
+	}
+
+	for _, c := range cases {
+		host, port, explicitPort, err := splitServerName(c.serverName)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.serverName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.serverName, err)
+			continue
+		}
+		if host != c.host || port != c.port || explicitPort != c.explicitPort {
+			t.Errorf("%s: got (%s, %s, %t), expected (%s, %s, %t)", c.serverName, host, port, explicitPort, c.host, c.port, c.explicitPort)
+		}
+	}
+}
+
+func TestOrderSrvRecords_Priority(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c.", Port: 3, Priority: 30, Weight: 10},
+		{Target: "a.", Port: 1, Priority: 10, Weight: 0},
+		{Target: "b.", Port: 2, Priority: 20, Weight: 50},
+	}
+
+	ordered := orderSrvRecords(records)
+	for i, expected := range []string{"a.", "b.", "c."} {
+		if ordered[i].Target != expected {
+			t.Errorf("Expected %s at position %d, got %s", expected, i, ordered[i].Target)
+		}
+	}
+}
+
+func TestOrderSrvRecords_Weight(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "light.", Port: 1, Priority: 10, Weight: 1},
+		{Target: "heavy.", Port: 2, Priority: 10, Weight: 1000},
+		{Target: "backup.", Port: 3, Priority: 20, Weight: 1000},
+	}
+
+	heavyFirst := 0
+	for i := 0; i < 200; i++ {
+		ordered := orderSrvRecords(records)
+		if len(ordered) != 3 {
+			t.Fatalf("Expected 3 records, got %d", len(ordered))
+		}
+		if ordered[2].Target != "backup." {
+			t.Fatalf("Expected the lower priority record last, got %s", ordered[2].Target)
+		}
+		if ordered[0].Target == "heavy." {
+			heavyFirst++
+		}
+	}
+
+	if heavyFirst < 150 {
+		t.Errorf("Expected the heavier record to usually come first, but it did %d/200 times", heavyFirst)
+	}
+}
+
+func wellKnownUrl(host string) string {
+	return "https://" + host + "/.well-known/matrix/server"
+}
+
+func TestResolveServer(t *testing.T) {
+	cases := []struct {
+		name          string
+		serverName    string
+		wellKnown     map[string]fakeResponse
+		srv           map[string][]*net.SRV
+		hostHeader    string
+		tlsServerName string
+		targets       []string
+		steps         []string
+		err           bool
+	}{
+		{
+			name:          "IPv4 literal",
+			serverName:    "1.2.3.4",
+			hostHeader:    "1.2.3.4",
+			tlsServerName: "1.2.3.4",
+			targets:       []string{"https://1.2.3.4:8448"},
+			steps:         []string{StepIpLiteral},
+		},
+		{
+			name:          "IPv6 literal with port",
+			serverName:    "[2001:db8::1]:8080",
+			hostHeader:    "[2001:db8::1]:8080",
+			tlsServerName: "2001:db8::1",
+			targets:       []string{"https://[2001:db8::1]:8080"},
+			steps:         []string{StepIpLiteral},
+		},
+		{
+			name:          "hostname with explicit port",
+			serverName:    "example.org:443",
+			hostHeader:    "example.org:443",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:443"},
+			steps:         []string{StepExplicitPort},
+		},
+		{
+			name:       "well-known delegates to an IP literal",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"5.6.7.8"}`},
+			},
+			hostHeader:    "5.6.7.8",
+			tlsServerName: "5.6.7.8",
+			targets:       []string{"https://5.6.7.8:8448"},
+			steps:         []string{StepWellKnown, StepIpLiteral},
+		},
+		{
+			name:       "well-known delegates with an explicit port",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org:8443"}`},
+			},
+			srv: map[string][]*net.SRV{
+				"_matrix-fed._tcp.matrix.example.org": {{Target: "ignored.example.org.", Port: 1}},
+			},
+			hostHeader:    "matrix.example.org:8443",
+			tlsServerName: "matrix.example.org",
+			targets:       []string{"https://matrix.example.org:8443"},
+			steps:         []string{StepWellKnown, StepExplicitPort},
+		},
+		{
+			name:       "well-known delegates to a hostname with SRV",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org"}`},
+			},
+			srv: map[string][]*net.SRV{
+				"_matrix-fed._tcp.matrix.example.org": {{Target: "fed.example.org.", Port: 443}},
+				"_matrix-fed._tcp.example.org":        {{Target: "wrong.example.org.", Port: 443}},
+			},
+			hostHeader:    "matrix.example.org",
+			tlsServerName: "matrix.example.org",
+			targets:       []string{"https://fed.example.org:443"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed},
+		},
+		{
+			name:       "well-known delegates to a hostname with deprecated SRV",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org"}`},
+			},
+			srv: map[string][]*net.SRV{
+				"_matrix._tcp.matrix.example.org": {{Target: "old.example.org.", Port: 8449}},
+			},
+			hostHeader:    "matrix.example.org",
+			tlsServerName: "matrix.example.org",
+			targets:       []string{"https://old.example.org:8449"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix},
+		},
+		{
+			name:       "well-known delegates to a hostname without SRV",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org"}`},
+			},
+			hostHeader:    "matrix.example.org",
+			tlsServerName: "matrix.example.org",
+			targets:       []string{"https://matrix.example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "SRV records are ordered by priority",
+			serverName: "example.org",
+			srv: map[string][]*net.SRV{
+				"_matrix-fed._tcp.example.org": {
+					{Target: "backup.example.org.", Port: 8448, Priority: 20},
+					{Target: "primary.example.org.", Port: 443, Priority: 10},
+				},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://primary.example.org:443", "https://backup.example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed},
+		},
+		{
+			name:       "matrix-fed SRV is preferred over matrix SRV",
+			serverName: "example.org",
+			srv: map[string][]*net.SRV{
+				"_matrix-fed._tcp.example.org": {{Target: "new.example.org.", Port: 443}},
+				"_matrix._tcp.example.org":     {{Target: "old.example.org.", Port: 8448}},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://new.example.org:443"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed},
+		},
+		{
+			name:       "SRV target of . is not available",
+			serverName: "example.org",
+			srv: map[string][]*net.SRV{
+				"_matrix-fed._tcp.example.org": {{Target: ".", Port: 0}},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "well-known that isn't JSON is ignored",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `<html>`},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "well-known with an error status is ignored",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 404, body: `{"m.server":"matrix.example.org"}`},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "well-known which is too large is ignored",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org","padding":"` + strings.Repeat("a", int(WellKnownMaxBodySize)) + `"}`},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "well-known with an invalid server name is ignored",
+			serverName: "example.org",
+			wellKnown: map[string]fakeResponse{
+				wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"a:b:c"}`},
+			},
+			hostHeader:    "example.org",
+			tlsServerName: "example.org",
+			targets:       []string{"https://example.org:8448"},
+			steps:         []string{StepWellKnown, StepSrvMatrixFed, StepSrvMatrix, StepFallback},
+		},
+		{
+			name:       "invalid server name",
+			serverName: ":8448",
+			steps:      []string{StepParse},
+			err:        true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakes(t, &fakeResolver{srv: c.srv}, &fakeHttpClient{responses: c.wellKnown})
+
+			res, err := ResolveServerUncached(c.serverName)
+			if c.err {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			steps := make([]string, 0)
+			for _, s := range res.Trace {
+				steps = append(steps, s.Step)
+			}
+			if strings.Join(steps, ",") != strings.Join(c.steps, ",") {
+				t.Errorf("Expected steps %v, got %v", c.steps, steps)
+			}
+			if c.err {
+				return
+			}
+
+			if res.HostHeader != c.hostHeader {
+				t.Errorf("Expected host header %s, got %s", c.hostHeader, res.HostHeader)
+			}
+			if res.TlsServerName != c.tlsServerName {
+				t.Errorf("Expected TLS server name %s, got %s", c.tlsServerName, res.TlsServerName)
+			}
+			urls := make([]string, 0)
+			for _, target := range res.Targets {
+				urls = append(urls, target.Url())
+			}
+			if strings.Join(urls, ",") != strings.Join(c.targets, ",") {
+				t.Errorf("Expected targets %v, got %v", c.targets, urls)
+			}
+		})
+	}
+}
+
+func TestResolveServer_CachesWellKnown(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{
+		wellKnownUrl("example.org"): {status: 200, body: `{"m.server":"matrix.example.org:443"}`},
+	}}
+	useFakes(t, &fakeResolver{}, client)
+
+	for i := 0; i < 3; i++ {
+		res, err := ResolveServerUncached("example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.HostHeader != "matrix.example.org:443" {
+			t.Errorf("Unexpected host header: %s", res.HostHeader)
+		}
+	}
+
+	if len(client.requests) != 1 {
+		t.Errorf("Expected 1 .well-known request, got %d", len(client.requests))
+	}
+}
+
+func TestResolveServer_WellKnownExpiresDuringResolution(t *testing.T) {
+	useFakes(t, &fakeResolver{srvDelay: 50 * time.Millisecond}, &fakeHttpClient{})
+
+	// The cached .well-known response runs out while the SRV lookups are still going
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	wellKnownCache.Set("example.org", &wellKnownResult{ServerAddr: "matrix.example.org", ExpiresAt: expiresAt}, 20*time.Millisecond)
+
+	res, err := ResolveServer("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.HostHeader != "matrix.example.org" {
+		t.Errorf("Unexpected host header: %s", res.HostHeader)
+	}
+	if cached := GetCachedResolution("example.org"); cached != nil {
+		t.Errorf("Expected a resolution based on an expired .well-known response not to be cached, got %+v", cached)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind describes why talking to a remote server failed, in terms a caller can act on.
+type ErrorKind string
+
+const (
+	ErrorKindDns         ErrorKind = "dns"
+	ErrorKindConnection  ErrorKind = "connection"
+	ErrorKindTls         ErrorKind = "tls"
+	ErrorKindTimeout     ErrorKind = "timeout"
+	ErrorKindBadResponse ErrorKind = "bad_response"
+	ErrorKindSignature   ErrorKind = "signature"
+	ErrorKindRateLimited ErrorKind = "rate_limited"
+	ErrorKindDenied      ErrorKind = "denied"
+	ErrorKindUnknown     ErrorKind = "unknown"
+)
+
+// InvalidSignatureError is returned when a remote server's response isn't signed correctly.
+type InvalidSignatureError struct {
+	Err error
+}
+
+func (e *InvalidSignatureError) Error() string {
+	return fmt.Sprintf("invalid signature: %v", e.Err)
+}
+
+func (e *InvalidSignatureError) Unwrap() error {
+	return e.Err
+}
+
+// Classify works out which kind of remote failure an error represents. Errors which don't
+// come from talking to a remote server are ErrorKindUnknown.
+func Classify(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+
+	var denied *ServerDeniedError
+	var blocked *BlockedAddressError
+	if errors.As(err, &denied) || errors.As(err, &blocked) {
+		return ErrorKindDenied
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) {
+		if status.StatusCode == http.StatusTooManyRequests {
+			return ErrorKindRateLimited
+		}
+		return ErrorKindBadResponse
+	}
+	var contentType *ContentTypeError
+	var tooLarge *ResponseTooLargeError
+	var invalid *InvalidResponseError
+	if errors.As(err, &contentType) || errors.As(err, &tooLarge) || errors.As(err, &invalid) {
+		return ErrorKindBadResponse
+	}
+
+	var signature *InvalidSignatureError
+	if errors.As(err, &signature) {
+		return ErrorKindSignature
+	}
+
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		return ErrorKindDns
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var certInvalid x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &certInvalid) ||
+		errors.As(err, &verification) || errors.As(err, &recordHeader) {
+		return ErrorKindTls
+	}
+	// TLS alerts from the remote end aren't exported, so fall back to their message
+	if strings.Contains(err.Error(), "tls: ") {
+		return ErrorKindTls
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorKindTimeout
+	}
+
+	var opErr *net.OpError
+	var unreachable *UnreachableError
+	if errors.As(err, &opErr) || errors.As(err, &unreachable) {
+		return ErrorKindConnection
+	}
+
+	return ErrorKindUnknown
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	attempt := func(err error) error {
+		return &UnreachableError{
+			ServerName: "example.org",
+			Attempts: []*AttemptError{
+				{Target: "example.org:8448", Address: "203.0.113.1", Err: errors.New("something earlier")},
+				{Target: "example.org:8448", Address: "203.0.113.2", Err: &url.Error{Op: "Get", URL: "https://203.0.113.2:8448", Err: err}},
+			},
+		}
+	}
+
+	cases := []struct {
+		name string
+		err  error
+		kind ErrorKind
+	}{
+		{"nil", nil, ""},
+		{"plain error", errors.New("database is on fire"), ErrorKindUnknown},
+		{"denied server", &ServerDeniedError{ServerName: "example.org"}, ErrorKindDenied},
+		{"blocked address", attempt(&net.OpError{Op: "dial", Err: &BlockedAddressError{Address: "10.0.0.1:8448"}}), ErrorKindDenied},
+		{"dns", attempt(&net.DNSError{Err: "no such host", Name: "example.org", IsNotFound: true}), ErrorKindDns},
+		{"connection refused", attempt(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), ErrorKindConnection},
+		{"no targets", &UnreachableError{ServerName: "example.org"}, ErrorKindConnection},
+		{"timeout", attempt(context.DeadlineExceeded), ErrorKindTimeout},
+		{"unknown authority", attempt(x509.UnknownAuthorityError{}), ErrorKindTls},
+		{"hostname mismatch", attempt(x509.HostnameError{Host: "example.org", Certificate: &x509.Certificate{}}), ErrorKindTls},
+		{"tls alert", attempt(errors.New("remote error: tls: handshake failure")), ErrorKindTls},
+		{"rate limited", &StatusError{StatusCode: 429}, ErrorKindRateLimited},
+		{"error status", &StatusError{StatusCode: 500}, ErrorKindBadResponse},
+		{"content type", &ContentTypeError{ContentType: "text/html"}, ErrorKindBadResponse},
+		{"too large", &ResponseTooLargeError{Limit: 1}, ErrorKindBadResponse},
+		{"invalid json", &InvalidResponseError{Err: errors.New("unexpected EOF")}, ErrorKindBadResponse},
+		{"signature", fmt.Errorf("wrapped: %w", &InvalidSignatureError{Err: errors.New("bad")}), ErrorKindSignature},
+	}
+
+	for _, c := range cases {
+		if kind := Classify(c.err); kind != c.kind {
+			t.Errorf("%s: expected %q, got %q", c.name, c.kind, kind)
+		}
+	}
+}
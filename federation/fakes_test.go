@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers DNS lookups from memory. SRV records are keyed by their full
+// name, eg: "_matrix-fed._tcp.example.org". SRV lookups take srvDelay to answer.
+type fakeResolver struct {
+	srv      map[string][]*net.SRV
+	ips      map[string][]string
+	srvDelay time.Duration
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error) {
+	time.Sleep(r.srvDelay)
+	full := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	if records, ok := r.srv[full]; ok {
+		return full, records, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: full, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ips[host]; ok {
+		addrs := make([]net.IPAddr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+type fakeResponse struct {
+	status  int
+	body    string
+	headers map[string]string
+	err     error
+}
+
+// fakeHttpClient answers requests from memory, keyed by URL. It records the requests it
+// receives so tests can inspect them.
+type fakeHttpClient struct {
+	responses map[string]fakeResponse
+	requests  []*http.Request
+	lock      sync.Mutex
+}
+
+func (c *fakeHttpClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	c.requests = append(c.requests, req)
+	c.lock.Unlock()
+
+	r, ok := c.responses[req.URL.String()]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	header := http.Header{}
+	for k, v := range r.headers {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		StatusCode:    r.status,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+		Request:       req,
+	}, nil
+}
+
+// useFakes points the package at in-memory DNS and HTTP for the duration of a test.
+func useFakes(t *testing.T, resolver *fakeResolver, client *fakeHttpClient) {
+	previousResolver := dnsResolver
+	previousWellKnown := wellKnownClient
+	previousFactory := federationClientFactory
+
+	dnsResolver = resolver
+	wellKnownClient = client
+	federationClientFactory = func(tlsServerName string) HttpClient {
+		return client
+	}
+	wellKnownCache.Flush()
+	resolvedServerCache.Flush()
+
+	t.Cleanup(func() {
+		dnsResolver = previousResolver
+		wellKnownClient = previousWellKnown
+		federationClientFactory = previousFactory
+		wellKnownCache.Flush()
+		resolvedServerCache.Flush()
+	})
+}
@@ -21,243 +21,223 @@
 package federation
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/alioygur/is"
-	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/meta"
 )
 
-var apiUrlCacheInstance *cache.Cache
-var apiUrlSingletonLock = &sync.Once{}
+// GetServerApiUrl returns the base URL of the most preferred target for a server name, and
+// the hostname to present to it.
+func GetServerApiUrl(hostname string) (string, string, error) {
+	logrus.Info("Getting server API URL for " + hostname)
 
-type cachedServer struct {
-	url      string
-	hostname string
+	res, err := ResolveServer(hostname)
+	if err != nil {
+		return "", "", err
+	}
+
+	url := res.Targets[0].Url()
+	logrus.Info("Server API URL for " + hostname + " is " + url)
+	return url, res.HostHeader, nil
 }
 
-type wellknownServerResponse struct {
-	ServerAddr string `json:"m.server"`
+// AttemptTimeout bounds each attempt to reach one address of a server, including reading
+// the response.
+var AttemptTimeout = 15 * time.Second
+
+// MaxAttempts and MaxRequestTime bound how long FederatedRequest keeps trying a server's
+// targets and addresses, so a server with many of them can't hold up a request for minutes.
+// An attempt already under way when MaxRequestTime runs out is allowed to finish.
+var MaxAttempts = 6
+var MaxRequestTime = 45 * time.Second
+
+type AttemptError struct {
+	Target  string
+	Address string
+	Err     error
 }
 
-func setupCache() {
-	if apiUrlCacheInstance == nil {
-		apiUrlSingletonLock.Do(func() {
-			apiUrlCacheInstance = cache.New(1*time.Hour, 2*time.Hour)
-		})
+func (e *AttemptError) Error() string {
+	if e.Address == "" {
+		return fmt.Sprintf("%s: %v", e.Target, e.Err)
 	}
+	return fmt.Sprintf("%s (%s): %v", e.Target, e.Address, e.Err)
 }
 
-func GetServerApiUrl(hostname string) (string, string, error) {
-	logrus.Info("Getting server API URL for " + hostname)
+func (e *AttemptError) Unwrap() error {
+	return e.Err
+}
 
-	// Check to see if we've cached this hostname at all
-	setupCache()
-	record, found := apiUrlCacheInstance.Get(hostname)
-	if found {
-		server := record.(cachedServer)
-		logrus.Info("Server API URL for " + hostname + " is " + server.url + " (cache)")
-		return server.url, server.hostname, nil
+// UnreachableError is returned when none of a server's targets could be reached.
+type UnreachableError struct {
+	ServerName string
+	Attempts   []*AttemptError
+}
+
+func (e *UnreachableError) Error() string {
+	if len(e.Attempts) == 0 {
+		return fmt.Sprintf("%s is unreachable: no targets to try", e.ServerName)
 	}
+	return fmt.Sprintf("%s is unreachable after %d attempt(s), last: %v", e.ServerName, len(e.Attempts), e.Attempts[len(e.Attempts)-1])
+}
 
-	h, p, err := net.SplitHostPort(hostname)
-	defPort := false
-	if err != nil && strings.HasSuffix(err.Error(), "missing port in address") {
-		h, p, err = net.SplitHostPort(hostname + ":8448")
-		defPort = true
+func (e *UnreachableError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
 	}
+	return e.Attempts[len(e.Attempts)-1]
+}
+
+// FederatedServerGet resolves a server name and GETs a path from it. See FederatedRequest.
+func FederatedServerGet(serverName string, path string) (*http.Response, error) {
+	err := CheckServerAllowed(serverName)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	// Step 1 of the discovery process: if the hostname is an IP, use that with explicit or default port
-	logrus.Debug("Testing if " + h + " is an IP address")
-	if is.IP(h) {
-		url := fmt.Sprintf("https://%s:%s", h, p)
-		server := cachedServer{url, hostname}
-		apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-		logrus.Info("Server API URL for " + hostname + " is " + url + " (IP address)")
-		return url, hostname, nil
+	res, err := ResolveServer(serverName)
+	if err != nil {
+		return nil, err
 	}
+	return FederatedRequest(res, "GET", path, nil, nil)
+}
 
-	// Step 2: if the hostname is not an IP address, and an explicit port is given, use that
-	logrus.Debug("Testing if a default port was used. Using default = ", defPort)
-	if !defPort {
-		url := fmt.Sprintf("https://%s:%s", h, p)
-		server := cachedServer{url, h}
-		apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-		logrus.Info("Server API URL for " + hostname + " is " + url + " (explicit port)")
-		return url, h, nil
-	}
+// FederatedRequest makes a request to a resolved server. Targets are tried in order, as are
+// the addresses each target resolves to, until one of them answers or MaxAttempts or
+// MaxRequestTime is reached. Only failures to get a response move on to the next address:
+// an HTTP error is still an answer.
+func FederatedRequest(res *ResolvedServer, method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	unreachable := &UnreachableError{ServerName: res.ServerName, Attempts: make([]*AttemptError, 0)}
+	deadline := time.Now().Add(MaxRequestTime)
+	attempts := 0
+
+	for _, target := range res.Targets {
+		if attempts >= MaxAttempts || time.Now().After(deadline) {
+			logrus.Warnf("Giving up on %s after %d attempt(s)", res.ServerName, attempts)
+			break
+		}
+		targetName := net.JoinHostPort(target.Host, target.Port)
+
+		addrs, err := target.Addresses()
+		if err != nil {
+			unreachable.Attempts = append(unreachable.Attempts, &AttemptError{Target: targetName, Err: err})
+			continue
+		}
+
+		for _, addr := range addrs {
+			if attempts >= MaxAttempts || time.Now().After(deadline) {
+				break
+			}
+			attempts++
 
-	// Step 3: if the hostname is not an IP address and no explicit port is given, do .well-known
-	// Note that we have sprawling branches here because we need to fall through to step 4 if parsing fails
-	logrus.Debug("Doing .well-known lookup on " + h)
-	r, err := http.Get(fmt.Sprintf("https://%s/.well-known/matrix/server", h))
-	if err == nil && r.StatusCode == http.StatusOK {
-		// Try parsing .well-known
-		c, err2 := ioutil.ReadAll(r.Body)
-		if err2 == nil {
-			wk := &wellknownServerResponse{}
-			err3 := json.Unmarshal(c, wk)
-			if err3 == nil && wk.ServerAddr != "" {
-				wkHost, wkPort, err4 := net.SplitHostPort(wk.ServerAddr)
-				wkDefPort := false
-				if err4 != nil && strings.HasSuffix(err4.Error(), "missing port in address") {
-					wkHost, wkPort, err4 = net.SplitHostPort(wk.ServerAddr + ":8448")
-					wkDefPort = true
-				}
-				if err4 == nil {
-					// Step 3a: if the delegated host is an IP address, use that (regardless of port)
-					logrus.Debug("Checking if WK host is an IP: " + wkHost)
-					if is.IP(wkHost) {
-						url := fmt.Sprintf("https://%s:%s", wkHost, wkPort)
-						server := cachedServer{url, wk.ServerAddr}
-						apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-						logrus.Info("Server API URL for " + hostname + " is " + url + " (WK; IP address)")
-						return url, wk.ServerAddr, nil
-					}
-
-					// Step 3b: if the delegated host is not an IP and an explicit port is given, use that
-					logrus.Debug("Checking if WK is using default port? ", wkDefPort)
-					if !wkDefPort {
-						url := fmt.Sprintf("https://%s:%s", wkHost, wkPort)
-						server := cachedServer{url, wkHost}
-						apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-						logrus.Info("Server API URL for " + hostname + " is " + url + " (WK; explicit port)")
-						return url, wkHost, nil
-					}
-
-					// Step 3c: if the delegated host is not an IP and doesn't have a port, start a SRV lookup and use it
-					// Note: we ignore errors here because the hostname will fail elsewhere.
-					logrus.Debug("Doing SRV (fed) on WK host ", wkHost)
-					_, addrs, _ := net.LookupSRV("matrix-fed", "tcp", wkHost)
-					if len(addrs) > 0 {
-						// Trim off the trailing period if there is one (golang doesn't like this)
-						realAddr := addrs[0].Target
-						if realAddr[len(realAddr)-1:] == "." {
-							realAddr = realAddr[0 : len(realAddr)-1]
-						}
-						url := fmt.Sprintf("https://%s:%d", realAddr, addrs[0].Port)
-						server := cachedServer{url, wkHost}
-						apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-						logrus.Info("Server API URL for " + hostname + " is " + url + " (WK; SRV)")
-						return url, wkHost, nil
-					}
-
-					// Step 3d: if the delegated host is not an IP and doesn't have a port, start a SRV lookup and use it
-					// Note: we ignore errors here because the hostname will fail elsewhere.
-					logrus.Debug("Doing SRV (deprecated) on WK host ", wkHost)
-					_, addrs, _ = net.LookupSRV("matrix", "tcp", wkHost)
-					if len(addrs) > 0 {
-						// Trim off the trailing period if there is one (golang doesn't like this)
-						realAddr := addrs[0].Target
-						if realAddr[len(realAddr)-1:] == "." {
-							realAddr = realAddr[0 : len(realAddr)-1]
-						}
-						url := fmt.Sprintf("https://%s:%d", realAddr, addrs[0].Port)
-						server := cachedServer{url, wkHost}
-						apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-						logrus.Info("Server API URL for " + hostname + " is " + url + " (WK; SRV)")
-						return url, wkHost, nil
-					}
-
-					// Step 3e: use the delegated host as-is
-					logrus.Debug("Using .well-known as-is for ", wkHost)
-					url := fmt.Sprintf("https://%s:%s", wkHost, wkPort)
-					server := cachedServer{url, wkHost}
-					apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-					logrus.Info("Server API URL for " + hostname + " is " + url + " (WK; fallback)")
-					return url, wkHost, nil
-				}
+			resp, err := AddressRequest(res, target, addr, method, path, body, header)
+			if err != nil {
+				logrus.Warnf("Failed to reach %s at %s: %v", res.ServerName, net.JoinHostPort(addr, target.Port), err)
+				unreachable.Attempts = append(unreachable.Attempts, &AttemptError{Target: targetName, Address: addr, Err: err})
+				continue
 			}
+			return resp, nil
 		}
 	}
 
-	// Step 4: try resolving a hostname using SRV records and use it
-	// Note: we ignore errors here because the hostname will fail elsewhere.
-	logrus.Debug("Doing SRV (fed) for host ", hostname)
-	_, addrs, _ := net.LookupSRV("matrix-fed", "tcp", hostname)
-	if len(addrs) > 0 {
-		// Trim off the trailing period if there is one (golang doesn't like this)
-		realAddr := addrs[0].Target
-		if realAddr[len(realAddr)-1:] == "." {
-			realAddr = realAddr[0 : len(realAddr)-1]
-		}
-		url := fmt.Sprintf("https://%s:%d", realAddr, addrs[0].Port)
-		server := cachedServer{url, h}
-		apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-		logrus.Info("Server API URL for " + hostname + " is " + url + " (SRV)")
-		return url, h, nil
+	return nil, unreachable
+}
+
+// Addresses resolves the IP addresses to connect to for a target.
+func (t Target) Addresses() ([]string, error) {
+	if net.ParseIP(t.Host) != nil {
+		return []string{t.Host}, nil
 	}
 
-	// Step 5: try resolving a hostname using SRV records and use it
-	// Note: we ignore errors here because the hostname will fail elsewhere.
-	logrus.Debug("Doing SRV (deprecated) for host ", hostname)
-	_, addrs, _ = net.LookupSRV("matrix", "tcp", hostname)
-	if len(addrs) > 0 {
-		// Trim off the trailing period if there is one (golang doesn't like this)
-		realAddr := addrs[0].Target
-		if realAddr[len(realAddr)-1:] == "." {
-			realAddr = realAddr[0 : len(realAddr)-1]
-		}
-		url := fmt.Sprintf("https://%s:%d", realAddr, addrs[0].Port)
-		server := cachedServer{url, h}
-		apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-		logrus.Info("Server API URL for " + hostname + " is " + url + " (SRV)")
-		return url, h, nil
+	ctx, cancel := context.WithTimeout(context.Background(), AttemptTimeout)
+	ips, err := dnsResolver.LookupIPAddr(ctx, t.Host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP.String())
+	}
+	return addrs, nil
+}
+
+// AddressRequest makes a single request to one address of a resolved server's target,
+// without failing over to any others. The address must be allowed for the server.
+func AddressRequest(res *ResolvedServer, target Target, addr string, method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &BlockedAddressError{Address: net.JoinHostPort(addr, target.Port)}
+	}
+	err := CheckAddressAllowed(res.ServerName, ip)
+	if err != nil {
+		return nil, err
 	}
 
-	// Step 6: use the target host as-is
-	logrus.Debug("Using host as-is: ", hostname)
-	url := fmt.Sprintf("https://%s:%s", h, p)
-	server := cachedServer{url, h}
-	apiUrlCacheInstance.Set(hostname, server, cache.DefaultExpiration)
-	logrus.Info("Server API URL for " + hostname + " is " + url + " (fallback)")
-	return url, h, nil
+	url := "https://" + net.JoinHostPort(addr, target.Port) + path
+	return attemptRequest(method, url, res.HostHeader, res.TlsServerName, body, header)
 }
 
+// FederatedGet makes a single GET request to a known URL, presenting realHost to it.
 func FederatedGet(url string, realHost string) (*http.Response, error) {
-	logrus.Info("Doing federated GET to " + url + " with host " + realHost)
+	tlsServerName := strings.Trim(realHost, "[]")
+	if h, _, err := net.SplitHostPort(realHost); err == nil {
+		tlsServerName = h
+	}
+
+	return attemptRequest("GET", url, realHost, tlsServerName, nil, nil)
+}
+
+func attemptRequest(method string, url string, hostHeader string, tlsServerName string, body []byte, header http.Header) (*http.Response, error) {
+	logrus.Info("Doing federated " + method + " to " + url + " with host " + hostHeader)
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), AttemptTimeout)
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	// Override the host to be compliant with the spec
-	req.Header.Set("Host", realHost)
-	req.Header.Set("User-Agent", "matrix-media-repo")
-	req.Host = realHost
-
-	// This is how we verify the certificate is valid for the host we expect.
-	// Previously using `req.URL.Host` we'd end up changing which server we were
-	// connecting to (ie: matrix.org instead of matrix.org.cdn.cloudflare.net),
-	// which obviously doesn't help us. We needed to do that though because the
-	// HTTP client doesn't verify against the req.Host certificate, but it does
-	// handle it off the req.URL.Host. So, we need to tell it which certificate
-	// to verify.
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				ServerName: realHost,
-			},
-		},
-		Timeout: 15 * time.Second,
+	for k, v := range header {
+		req.Header[k] = v
 	}
 
-	resp, err := client.Do(req)
+	// Override the host to be compliant with the spec
+	req.Header.Set("Host", hostHeader)
+	req.Header.Set("User-Agent", "matrix-key-server/"+meta.AppVersion)
+	req.Host = hostHeader
+
+	resp, err := federationClientFactory(tlsServerName).Do(req)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
+	// The attempt's deadline covers reading the body too, so release it once the caller is done
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 	return resp, nil
 }
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFederatedRequest_FailsOver(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{
+		"https://203.0.113.1:443/_matrix/key/v2/server":  {err: errors.New("connection reset")},
+		"https://203.0.113.2:443/_matrix/key/v2/server":  {status: 200, body: `{}`},
+		"https://203.0.113.3:8448/_matrix/key/v2/server": {status: 200, body: `{}`},
+	}}
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_matrix-fed._tcp.example.org": {
+				{Target: "down.example.org.", Port: 443, Priority: 1},
+				{Target: "up.example.org.", Port: 443, Priority: 2},
+				{Target: "backup.example.org.", Port: 8448, Priority: 3},
+			},
+		},
+		ips: map[string][]string{
+			"up.example.org":     {"203.0.113.1", "203.0.113.2"},
+			"backup.example.org": {"203.0.113.3"},
+		},
+	}
+	useFakes(t, resolver, client)
+
+	resp, err := FederatedServerGet("example.org", "/_matrix/key/v2/server")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.Request.URL.Host != "203.0.113.2:443" {
+		t.Errorf("Expected the answer from 203.0.113.2:443, got %s", resp.Request.URL.Host)
+	}
+	if resp.Request.Host != "example.org" {
+		t.Errorf("Expected host header example.org, got %s", resp.Request.Host)
+	}
+	// One .well-known lookup, then one request to each address up to the one which answered
+	if len(client.requests) != 3 {
+		t.Errorf("Expected 3 requests, got %d", len(client.requests))
+	}
+}
+
+func TestFederatedRequest_Unreachable(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{}}
+	resolver := &fakeResolver{
+		ips: map[string][]string{
+			"example.org": {"203.0.113.1", "2001:db8::1"},
+		},
+	}
+	useFakes(t, resolver, client)
+
+	_, err := FederatedServerGet("example.org", "/_matrix/key/v2/server")
+	var unreachable *UnreachableError
+	if !errors.As(err, &unreachable) {
+		t.Fatalf("Expected an UnreachableError, got %v", err)
+	}
+	if len(unreachable.Attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(unreachable.Attempts))
+	}
+	if unreachable.Attempts[1].Address != "2001:db8::1" {
+		t.Errorf("Expected the last attempt to be 2001:db8::1, got %s", unreachable.Attempts[1].Address)
+	}
+}
+
+func TestFederatedRequest_LimitsAttempts(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{}}
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_matrix-fed._tcp.example.org": {
+				{Target: "a.example.org.", Port: 8448, Priority: 1},
+				{Target: "b.example.org.", Port: 8448, Priority: 2},
+			},
+		},
+		ips: map[string][]string{
+			"a.example.org": {"203.0.113.1", "203.0.113.2", "203.0.113.3"},
+			"b.example.org": {"203.0.113.4", "203.0.113.5", "203.0.113.6"},
+		},
+	}
+	useFakes(t, resolver, client)
+
+	previousAttempts := MaxAttempts
+	previousTime := MaxRequestTime
+	t.Cleanup(func() {
+		MaxAttempts = previousAttempts
+		MaxRequestTime = previousTime
+	})
+
+	MaxAttempts = 4
+	_, err := FederatedServerGet("example.org", "/_matrix/key/v2/server")
+	var unreachable *UnreachableError
+	if !errors.As(err, &unreachable) {
+		t.Fatalf("Expected an UnreachableError, got %v", err)
+	}
+	if len(unreachable.Attempts) != 4 {
+		t.Errorf("Expected 4 attempts, got %d", len(unreachable.Attempts))
+	}
+
+	MaxAttempts = previousAttempts
+	MaxRequestTime = -1 * time.Second
+	_, err = FederatedServerGet("example.org", "/_matrix/key/v2/server")
+	if !errors.As(err, &unreachable) {
+		t.Fatalf("Expected an UnreachableError, got %v", err)
+	}
+	if len(unreachable.Attempts) != 0 {
+		t.Errorf("Expected no attempts once the time is up, got %d", len(unreachable.Attempts))
+	}
+}
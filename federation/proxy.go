@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig sends outbound requests through an HTTP(S) or SOCKS5 proxy. Destinations
+// matching a bypass rule (server names, globs, or CIDR ranges, as with ServerAcl) are
+// connected to directly.
+type ProxyConfig struct {
+	Url         *url.URL
+	bypassNames []string
+	bypassNets  []*net.IPNet
+}
+
+var proxyConfig *ProxyConfig
+
+// SetProxy replaces the proxy used for outbound requests. A nil config connects directly.
+func SetProxy(p *ProxyConfig) {
+	proxyConfig = p
+	resetHttpClients()
+}
+
+func NewProxyConfig(proxyUrl string, bypass []string) (*ProxyConfig, error) {
+	if proxyUrl == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %s is missing a hostname", proxyUrl)
+	}
+
+	p := &ProxyConfig{Url: u}
+	p.bypassNames, p.bypassNets, err = parseAclRules(bypass)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// address is the host:port the transport dials to reach the proxy.
+func (p *ProxyConfig) address() string {
+	port := p.Url.Port()
+	if port == "" {
+		switch p.Url.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(p.Url.Hostname(), port)
+}
+
+// bypasses returns true if a request should skip the proxy. Federation requests are made to
+// an IP address with the server name in the Host header, so both are checked.
+func (p *ProxyConfig) bypasses(req *http.Request) bool {
+	for _, host := range []string{req.URL.Host, req.Host} {
+		if host == "" {
+			continue
+		}
+		host = strings.ToLower(host)
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		hostname = strings.Trim(hostname, "[]")
+
+		if matchesName(p.bypassNames, host, hostname) {
+			return true
+		}
+		if ip := net.ParseIP(hostname); ip != nil && containsIp(p.bypassNets, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyFunc picks the proxy for a request, for use as http.Transport.Proxy. The proxy makes
+// the connection to the destination rather than our guarded dialer, so when guarded is set
+// address destinations are checked here instead. Every kind of proxy is handed hostnames to
+// resolve itself (socks5 behaves like socks5h in http.Transport, and HTTP proxies are sent
+// CONNECT host:port), so checking our own lookup of a hostname would prove nothing: the proxy
+// has to keep those requests away from private addresses.
+func proxyFunc(guarded bool) func(req *http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		p := proxyConfig
+		if p == nil || p.bypasses(req) {
+			return nil, nil
+		}
+
+		if guarded {
+			if ip := net.ParseIP(req.URL.Hostname()); ip != nil {
+				err := checkDialedAddress(net.JoinHostPort(ip.String(), req.URL.Port()), ip)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return p.Url, nil
+	}
+}
+
+// proxyAwareDial dials through the given dialer, except for connections to the proxy itself:
+// the proxy is configured by the operator, so it may well live on a private address.
+func proxyAwareDial(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if p := proxyConfig; p != nil && address == p.address() {
+			direct := &net.Dialer{Timeout: dialer.Timeout, KeepAlive: dialer.KeepAlive, Resolver: dialer.Resolver}
+			return direct.DialContext(ctx, network, address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNewProxyConfig(t *testing.T) {
+	cases := []struct {
+		url     string
+		address string
+		err     bool
+	}{
+		{"http://proxy.internal", "proxy.internal:80", false},
+		{"https://proxy.internal", "proxy.internal:443", false},
+		{"socks5://10.0.0.1", "10.0.0.1:1080", false},
+		{"socks5h://user:pass@[fd00::1]:9050", "[fd00::1]:9050", false},
+		{"ftp://proxy.internal", "", true},
+		{"proxy.internal:3128", "", true},
+		{"http://", "", true},
+	}
+	for _, c := range cases {
+		p, err := NewProxyConfig(c.url, nil)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.url, err)
+			continue
+		}
+		if p.address() != c.address {
+			t.Errorf("%s: expected address %s, got %s", c.url, c.address, p.address())
+		}
+	}
+
+	p, err := NewProxyConfig("", []string{"example.org"})
+	if p != nil || err != nil {
+		t.Errorf("Expected no proxy and no error for an empty URL, got %v, %v", p, err)
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	useFakes(t, &fakeResolver{ips: map[string][]string{
+		"example.org":  {"8.8.8.8"},
+		"internal.org": {"10.1.2.3"},
+	}}, &fakeHttpClient{})
+
+	p, err := NewProxyConfig("http://proxy.internal:3128", []string{"*.bypass.org", "1.1.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := proxyConfig
+	proxyConfig = p
+	t.Cleanup(func() {
+		proxyConfig = previous
+	})
+
+	cases := []struct {
+		name    string
+		url     string
+		host    string
+		guarded bool
+		proxied bool
+		blocked bool
+	}{
+		{"public hostname", "https://example.org/.well-known/matrix/server", "", true, true, false},
+		{"public address", "https://8.8.4.4:8448/_matrix/key/v2/server", "example.org", true, true, false},
+		{"bypassed server name", "https://8.8.4.4:8448/_matrix/key/v2/server", "matrix.bypass.org", true, false, false},
+		{"bypassed address", "https://1.1.1.1:443/_matrix/key/v2/server", "example.org", true, false, false},
+		{"private address", "https://192.168.1.1:8448/_matrix/key/v2/server", "example.org", true, false, true},
+		{"hostname with a private address", "https://internal.org/.well-known/matrix/server", "", true, true, false},
+		{"unguarded private address", "https://192.168.1.1/dns-query", "", false, true, false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if c.host != "" {
+			req.Host = c.host
+		}
+
+		u, err := proxyFunc(c.guarded)(req)
+		var blocked *BlockedAddressError
+		if errors.As(err, &blocked) != c.blocked {
+			t.Errorf("%s: expected blocked=%v, got error %v", c.name, c.blocked, err)
+		}
+		if (u != nil) != c.proxied {
+			t.Errorf("%s: expected proxied=%v, got %v", c.name, c.proxied, u)
+		}
+	}
+}
+
+func TestProxyFunc_ProxyResolvesNames(t *testing.T) {
+	// Nothing resolves locally, as when only the proxy can reach a DNS server
+	useFakes(t, &fakeResolver{}, &fakeHttpClient{})
+	previous := proxyConfig
+	t.Cleanup(func() {
+		proxyConfig = previous
+	})
+
+	for _, proxyUrl := range []string{"http://proxy.internal:3128", "socks5://proxy.internal:1080", "socks5h://proxy.internal:9050"} {
+		p, err := NewProxyConfig(proxyUrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyConfig = p
+
+		req, _ := http.NewRequest("GET", "https://example.org/.well-known/matrix/server", nil)
+		u, err := proxyFunc(true)(req)
+		if err != nil || u == nil {
+			t.Errorf("%s: expected the hostname to be left for the proxy to resolve, got %v, %v", proxyUrl, u, err)
+		}
+
+		req, _ = http.NewRequest("GET", "https://192.168.1.1:8448/_matrix/key/v2/server", nil)
+		_, err = proxyFunc(true)(req)
+		var blocked *BlockedAddressError
+		if !errors.As(err, &blocked) {
+			t.Errorf("%s: expected a private address to still be blocked, got %v", proxyUrl, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Resolver performs the DNS lookups needed for server discovery. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service string, proto string, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var dnsResolver Resolver = net.DefaultResolver
+
+// SetResolver replaces the resolver used for server discovery and outbound connections.
+func SetResolver(r Resolver) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	dnsResolver = r
+	resetHttpClients()
+}
+
+// NewResolver creates a resolver which sends its queries to the given DNS server. The server
+// is either an address like "9.9.9.9:53" (plain DNS), or an https:// URL of an RFC 8484
+// DNS-over-HTTPS endpoint. An empty server uses the system's resolver.
+func NewResolver(server string) (Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+
+	if strings.HasPrefix(server, "https://") {
+		// The DNS-over-HTTPS server is chosen by the operator, so it isn't subject to the
+		// private address block, but it does go through the proxy if there is one.
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy:               proxyFunc(false),
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+			Timeout: 10 * time.Second,
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, endpoint: server, client: client}, nil
+			},
+		}, nil
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// netResolver returns the configured resolver if dialers can use it directly.
+func netResolver() *net.Resolver {
+	if r, ok := dnsResolver.(*net.Resolver); ok {
+		return r
+	}
+	return nil
+}
+
+const dohMaxResponseSize = 65535
+
+// dohConn carries a single DNS exchange over HTTPS. Go's resolver treats connections which
+// aren't a net.PacketConn like TCP, so queries and responses are prefixed with their length.
+type dohConn struct {
+	ctx      context.Context
+	endpoint string
+	client   *http.Client
+	query    bytes.Buffer
+	response *bytes.Reader
+	deadline time.Time
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if c.response != nil {
+		return 0, errors.New("DNS-over-HTTPS connections only carry one query")
+	}
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response == nil {
+		err := c.exchange()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) exchange() error {
+	q := c.query.Bytes()
+	if len(q) < 2 || int(binary.BigEndian.Uint16(q)) != len(q)-2 {
+		return errors.New("incomplete DNS query")
+	}
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewReader(q[2:]))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS-over-HTTPS server returned status code %d", resp.StatusCode)
+	}
+
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(msg) > dohMaxResponseSize {
+		return errors.New("DNS-over-HTTPS response is too large")
+	}
+
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	c.response = bytes.NewReader(framed)
+	return nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr("local") }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.endpoint) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
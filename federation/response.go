@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// How much of an error response's body is kept for StatusError.
+const statusErrorBodySize = 1024
+
+// StatusError is returned when a remote server answers with a non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Body)
+}
+
+// ContentTypeError is returned when a remote server answers with something other than JSON.
+type ContentTypeError struct {
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("unexpected content type %q", e.ContentType)
+}
+
+// ResponseTooLargeError is returned when a response body is larger than we're willing to read.
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response is larger than the limit of %d bytes", e.Limit)
+}
+
+// InvalidResponseError is returned when a response body can't be read or decoded.
+type InvalidResponseError struct {
+	Err error
+}
+
+func (e *InvalidResponseError) Error() string {
+	return fmt.Sprintf("invalid response: %v", e.Err)
+}
+
+func (e *InvalidResponseError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeJsonResponse decodes a JSON response body into v, reading at most maxSize bytes.
+// The body is always closed.
+func DecodeJsonResponse(resp *http.Response, maxSize int64, v interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, statusErrorBodySize))
+		return &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+
+	// Some servers don't send a content type at all, which we tolerate. Anything else has
+	// to claim to be JSON.
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return &ContentTypeError{ContentType: contentType}
+		}
+	}
+
+	if resp.ContentLength > maxSize {
+		return &ResponseTooLargeError{Limit: maxSize}
+	}
+
+	decoder := json.NewDecoder(&limitedReader{r: resp.Body, remaining: maxSize, limit: maxSize})
+	err := decoder.Decode(v)
+	if err != nil {
+		var tooLarge *ResponseTooLargeError
+		if errors.As(err, &tooLarge) {
+			return tooLarge
+		}
+		return &InvalidResponseError{Err: err}
+	}
+	return nil
+}
+
+// limitedReader is like io.LimitedReader, but fails rather than silently truncating.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &ResponseTooLargeError{Limit: l.limit}
+	}
+	// Read one byte past the limit so we can tell a body of exactly the limit from a larger one
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, &ResponseTooLargeError{Limit: l.limit}
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDecodeJsonResponse(t *testing.T) {
+	cases := []struct {
+		name          string
+		status        int
+		contentType   string
+		body          string
+		contentLength int64
+		check         func(err error) bool
+	}{
+		{"valid", 200, "application/json", `{"a":"b"}`, -1, func(err error) bool {
+			return err == nil
+		}},
+		{"valid with charset", 200, "application/json; charset=utf-8", `{"a":"b"}`, -1, func(err error) bool {
+			return err == nil
+		}},
+		{"valid without content type", 200, "", `{"a":"b"}`, -1, func(err error) bool {
+			return err == nil
+		}},
+		{"exactly the limit", 200, "application/json", `{"a":"` + strings.Repeat("b", 22) + `"}`, -1, func(err error) bool {
+			return err == nil
+		}},
+		{"error status", 404, "application/json", `{"errcode":"M_NOT_FOUND"}`, -1, func(err error) bool {
+			var e *StatusError
+			return errors.As(err, &e) && e.StatusCode == 404 && e.Body == `{"errcode":"M_NOT_FOUND"}`
+		}},
+		{"wrong content type", 200, "text/html", `{"a":"b"}`, -1, func(err error) bool {
+			var e *ContentTypeError
+			return errors.As(err, &e) && e.ContentType == "text/html"
+		}},
+		{"too large", 200, "application/json", `{"a":"` + strings.Repeat("b", 100) + `"}`, -1, func(err error) bool {
+			var e *ResponseTooLargeError
+			return errors.As(err, &e) && e.Limit == 30
+		}},
+		{"too large by content length", 200, "application/json", `{}`, 1000, func(err error) bool {
+			var e *ResponseTooLargeError
+			return errors.As(err, &e)
+		}},
+		{"not JSON", 200, "application/json", `<html>`, -1, func(err error) bool {
+			var e *InvalidResponseError
+			return errors.As(err, &e)
+		}},
+		{"truncated", 200, "application/json", `{"a":`, -1, func(err error) bool {
+			var e *InvalidResponseError
+			return errors.As(err, &e)
+		}},
+	}
+
+	for _, c := range cases {
+		body := &closeTracker{Reader: strings.NewReader(c.body)}
+		resp := &http.Response{
+			StatusCode:    c.status,
+			Header:        http.Header{},
+			Body:          body,
+			ContentLength: c.contentLength,
+		}
+		if c.contentType != "" {
+			resp.Header.Set("Content-Type", c.contentType)
+		}
+
+		v := make(map[string]interface{})
+		err := DecodeJsonResponse(resp, 30, &v)
+		if !c.check(err) {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !body.closed {
+			t.Errorf("%s: expected the body to be closed", c.name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// ServerAcl decides which server names the key server is willing to contact. Rules
+// may be exact server names, globs (eg: "*.example.org"), or CIDR ranges. CIDR ranges
+// apply to IP literal server names and to the addresses we connect to for a server.
+type ServerAcl struct {
+	allowNames []string
+	allowNets  []*net.IPNet
+	denyNames  []string
+	denyNets   []*net.IPNet
+}
+
+type ServerDeniedError struct {
+	ServerName string
+	Reason     string
+}
+
+func (e *ServerDeniedError) Error() string {
+	return fmt.Sprintf("server %s is not allowed: %s", e.ServerName, e.Reason)
+}
+
+var serverAcl = &ServerAcl{}
+
+// SetServerAcl replaces the rules used by CheckServerAllowed.
+func SetServerAcl(acl *ServerAcl) {
+	if acl == nil {
+		acl = &ServerAcl{}
+	}
+	serverAcl = acl
+}
+
+// CheckServerAllowed returns a *ServerDeniedError if the configured rules do not permit
+// contacting the given server name.
+func CheckServerAllowed(serverName string) error {
+	return serverAcl.Check(serverName)
+}
+
+// CheckAddressAllowed returns a *ServerDeniedError if the configured rules do not permit
+// connecting to the given address for a server.
+func CheckAddressAllowed(serverName string, ip net.IP) error {
+	return serverAcl.CheckAddress(serverName, ip)
+}
+
+func NewServerAcl(allow []string, deny []string) (*ServerAcl, error) {
+	acl := &ServerAcl{}
+
+	var err error
+	acl.allowNames, acl.allowNets, err = parseAclRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	acl.denyNames, acl.denyNets, err = parseAclRules(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func parseAclRules(rules []string) ([]string, []*net.IPNet, error) {
+	names := make([]string, 0)
+	nets := make([]*net.IPNet, 0)
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+
+		if strings.Contains(rule, "/") {
+			_, n, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+
+		if ip := net.ParseIP(strings.Trim(rule, "[]")); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		// Validate the glob now so we don't find out on the first request
+		if _, err := path.Match(rule, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid server name rule %s: %v", rule, err)
+		}
+		names = append(names, rule)
+	}
+
+	return names, nets, nil
+}
+
+// Check decides whether a server name may be contacted, going by the name alone. CIDR ranges
+// only apply to IP literal server names here: the addresses a hostname is reached at aren't
+// known until it has been resolved, so CheckAddress covers those.
+func (a *ServerAcl) Check(serverName string) error {
+	serverName, host, ip := parseAclServerName(serverName)
+
+	if matchesName(a.denyNames, serverName, host) {
+		return &ServerDeniedError{serverName, "server name is denied"}
+	}
+	if ip != nil && containsIp(a.denyNets, ip) {
+		return &ServerDeniedError{serverName, "address is denied"}
+	}
+
+	if a.allowsName(serverName, host, ip) {
+		return nil
+	}
+	// A hostname may still be allowed by the addresses it is reached at
+	if ip == nil && len(a.allowNets) > 0 {
+		return nil
+	}
+
+	return &ServerDeniedError{serverName, "server is not on the allow list"}
+}
+
+// CheckAddress decides whether an address may be connected to for a server. Denied names and
+// ranges always apply. Allowed ranges only matter if the server name isn't allowed by itself.
+func (a *ServerAcl) CheckAddress(serverName string, ip net.IP) error {
+	serverName, host, nameIp := parseAclServerName(serverName)
+
+	if matchesName(a.denyNames, serverName, host) {
+		return &ServerDeniedError{serverName, "server name is denied"}
+	}
+	if containsIp(a.denyNets, ip) {
+		return &ServerDeniedError{serverName, "address " + ip.String() + " is denied"}
+	}
+	if a.allowsName(serverName, host, nameIp) || containsIp(a.allowNets, ip) {
+		return nil
+	}
+
+	return &ServerDeniedError{serverName, "address " + ip.String() + " is not on the allow list"}
+}
+
+// allowsName returns true if there is no allow list, or the server name is on it.
+func (a *ServerAcl) allowsName(serverName string, host string, ip net.IP) bool {
+	if len(a.allowNames) == 0 && len(a.allowNets) == 0 {
+		return true
+	}
+	if matchesName(a.allowNames, serverName, host) {
+		return true
+	}
+	return ip != nil && containsIp(a.allowNets, ip)
+}
+
+// parseAclServerName lowercases a server name and works out its host, and its address if the
+// host is an IP literal.
+func parseAclServerName(serverName string) (string, string, net.IP) {
+	serverName = strings.ToLower(serverName)
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return serverName, host, net.ParseIP(host)
+}
+
+func matchesName(patterns []string, serverName string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, serverName); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIp(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestServerAcl_DenyList(t *testing.T) {
+	useFakes(t, &fakeResolver{ips: map[string][]string{
+		"example.org":          {"93.184.216.34"},
+		"internal.example.org": {"93.184.216.35", "10.0.0.5"},
+	}}, &fakeHttpClient{})
+
+	acl, err := NewServerAcl(nil, []string{"bad.example.org", "*.evil.org", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAcl(acl, "example.org", true, t)
+	checkAcl(acl, "bad.example.org", false, t)
+	checkAcl(acl, "bad.example.org:8448", false, t)
+	checkAcl(acl, "BAD.example.org", false, t)
+	checkAcl(acl, "a.evil.org", false, t)
+	checkAcl(acl, "10.1.2.3", false, t)
+	checkAcl(acl, "10.1.2.3:8448", false, t)
+	checkAcl(acl, "[::1]:8448", false, t)
+	checkAcl(acl, "1.2.3.4", true, t)
+
+	// Hostnames aren't resolved by Check: the addresses we connect to are checked instead
+	checkAcl(acl, "internal.example.org", true, t)
+	checkAcl(acl, "unresolvable.example.org", true, t)
+	checkAclAddress(acl, "internal.example.org", "93.184.216.35", true, t)
+	checkAclAddress(acl, "internal.example.org", "10.0.0.5", false, t)
+	checkAclAddress(acl, "example.org", "::1", false, t)
+	checkAclAddress(acl, "bad.example.org", "93.184.216.34", false, t)
+}
+
+func TestServerAcl_DeniedDelegatedAddress(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{
+		"https://203.0.113.1:8448/_matrix/key/v2/server": {status: 200, body: `{}`},
+	}}
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_matrix-fed._tcp.example.org": {{Target: "hidden.example.net.", Port: 8448}},
+		},
+		ips: map[string][]string{
+			"hidden.example.net": {"203.0.113.1"},
+		},
+	}
+	useFakes(t, resolver, client)
+
+	acl, err := NewServerAcl(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetServerAcl(acl)
+	defer SetServerAcl(nil)
+
+	// The server name has no addresses of its own, which is fine, but where it delegates to is denied
+	checkAcl(acl, "example.org", true, t)
+	_, err = FederatedServerGet("example.org", "/_matrix/key/v2/server")
+	var denied *ServerDeniedError
+	if !errors.As(err, &denied) {
+		t.Errorf("Expected the delegated address to be denied, got %v", err)
+	}
+	for _, req := range client.requests {
+		if req.URL.Host == "203.0.113.1:8448" {
+			t.Error("Expected no request to the denied address")
+		}
+	}
+}
+
+func TestServerAcl_AllowList(t *testing.T) {
+	acl, err := NewServerAcl([]string{"example.org", "*.example.com", "192.0.2.0/24"}, []string{"no.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAcl(acl, "example.org", true, t)
+	checkAcl(acl, "example.org:443", true, t)
+	checkAcl(acl, "a.example.com", true, t)
+	checkAcl(acl, "no.example.com", false, t)
+	checkAcl(acl, "192.0.2.10", true, t)
+	checkAcl(acl, "198.51.100.1", false, t)
+
+	// Other hostnames are allowed if the addresses they are reached at are
+	checkAcl(acl, "other.example.net", true, t)
+	checkAclAddress(acl, "other.example.net", "192.0.2.20", true, t)
+	checkAclAddress(acl, "other.example.net", "198.51.100.1", false, t)
+	checkAclAddress(acl, "example.org", "198.51.100.1", true, t)
+}
+
+func TestServerAcl_InvalidRule(t *testing.T) {
+	_, err := NewServerAcl([]string{"10.0.0.0/99"}, nil)
+	if err == nil {
+		t.Error("Expected an error for an invalid CIDR range")
+	}
+
+	_, err = NewServerAcl([]string{"[bad"}, nil)
+	if err == nil {
+		t.Error("Expected an error for an invalid glob")
+	}
+}
+
+func checkAcl(acl *ServerAcl, serverName string, expectAllowed bool, t *testing.T) {
+	err := acl.Check(serverName)
+	if expectAllowed && err != nil {
+		t.Errorf("Expected %s to be allowed, got: %v", serverName, err)
+	} else if !expectAllowed && err == nil {
+		t.Errorf("Expected %s to be denied", serverName)
+	}
+}
+
+func checkAclAddress(acl *ServerAcl, serverName string, addr string, expectAllowed bool, t *testing.T) {
+	err := acl.CheckAddress(serverName, net.ParseIP(addr))
+	if expectAllowed && err != nil {
+		t.Errorf("Expected %s to be allowed for %s, got: %v", addr, serverName, err)
+	} else if !expectAllowed && err == nil {
+		t.Errorf("Expected %s to be denied for %s", addr, serverName)
+	}
+}
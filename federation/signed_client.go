@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/xmatrix"
+	"golang.org/x/crypto/ed25519"
+)
+
+// RequestSigner authenticates outbound federation requests as Origin, using the X-Matrix
+// scheme from the server-server API specification.
+type RequestSigner struct {
+	Origin string
+	KeyID  models.KeyID
+	Key    ed25519.PrivateKey
+}
+
+// AuthorizationHeader signs a request and returns the value for its Authorization header.
+// The uri is the path and query string of the request, and content is its JSON body, or
+// nil if there isn't one.
+func (s *RequestSigner) AuthorizationHeader(method string, destination string, uri string, content []byte) (string, error) {
+	obj := map[string]interface{}{
+		"method":      method,
+		"uri":         uri,
+		"origin":      s.Origin,
+		"destination": destination,
+	}
+	if content != nil {
+		var parsed interface{}
+		err := json.Unmarshal(content, &parsed)
+		if err != nil {
+			return "", err
+		}
+		obj["content"] = parsed
+	}
+
+	signed, err := signing.SignObject(obj, s.Origin, s.KeyID, s.Key)
+	if err != nil {
+		return "", err
+	}
+	sig, ok := signed["signatures"].(map[string]interface{})[s.Origin].(map[string]interface{})[string(s.KeyID)].(string)
+	if !ok {
+		return "", errors.New("signature missing from signed request")
+	}
+
+	auth := &xmatrix.Auth{
+		Origin:      s.Origin,
+		Destination: destination,
+		KeyID:       string(s.KeyID),
+		Signature:   sig,
+	}
+	return auth.String(), nil
+}
+
+// SignedRequest makes an authenticated request to a remote server. The content, if not nil,
+// is sent as the JSON body. See FederatedRequest for how the server is contacted.
+func SignedRequest(signer *RequestSigner, serverName string, method string, uri string, content interface{}) (*http.Response, error) {
+	// Don't sign anything for, or even look up, a server we may not contact
+	err := CheckServerAllowed(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if content != nil {
+		body, err = json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := signer.AuthorizationHeader(method, serverName, uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ResolveServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", auth)
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	return FederatedRequest(res, method, uri, body, header)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/signing"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testSigningKey = ed25519.NewKeyFromSeed([]byte("00000000000000000000000000000000"))
+
+var authHeaderPattern = regexp.MustCompile(`^X-Matrix origin="([^"]+)",destination="([^"]+)",key="([^"]+)",sig="([^"]+)"$`)
+
+func verifyAuthHeader(t *testing.T, header string, method string, destination string, uri string, content interface{}) {
+	m := authHeaderPattern.FindStringSubmatch(header)
+	if m == nil {
+		t.Fatalf("Unexpected Authorization header: %s", header)
+	}
+	if m[1] != "origin.example.org" || m[2] != destination || m[3] != "ed25519:test" {
+		t.Errorf("Unexpected Authorization header params: %s", header)
+	}
+
+	obj := map[string]interface{}{
+		"method":      method,
+		"uri":         uri,
+		"origin":      "origin.example.org",
+		"destination": destination,
+		"signatures": map[string]interface{}{
+			"origin.example.org": map[string]interface{}{
+				"ed25519:test": m[4],
+			},
+		},
+	}
+	if content != nil {
+		obj["content"] = content
+	}
+	err := signing.VerifySignatures(obj, map[string]map[string]ed25519.PublicKey{
+		"origin.example.org": {"ed25519:test": testSigningKey.Public().(ed25519.PublicKey)},
+	})
+	if err != nil {
+		t.Errorf("Signature did not verify: %v", err)
+	}
+}
+
+func TestRequestSigner_AuthorizationHeader(t *testing.T) {
+	signer := &RequestSigner{Origin: "origin.example.org", KeyID: "ed25519:test", Key: testSigningKey}
+
+	auth, err := signer.AuthorizationHeader("GET", "dest.example.org", "/_matrix/federation/v1/query/profile?user_id=%40alice%3Adest.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyAuthHeader(t, auth, "GET", "dest.example.org", "/_matrix/federation/v1/query/profile?user_id=%40alice%3Adest.example.org", nil)
+
+	auth, err = signer.AuthorizationHeader("PUT", "dest.example.org", "/_matrix/federation/v1/send/1", []byte(`{"pdus":[],"edus":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyAuthHeader(t, auth, "PUT", "dest.example.org", "/_matrix/federation/v1/send/1", map[string]interface{}{
+		"pdus": []interface{}{},
+		"edus": []interface{}{},
+	})
+}
+
+func TestSignedRequest(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{
+		"https://198.51.100.7:8448/_matrix/federation/v1/user/keys/query": {status: 200, body: `{}`},
+	}}
+	useFakes(t, &fakeResolver{ips: map[string][]string{"dest.example.org": {"198.51.100.7"}}}, client)
+
+	signer := &RequestSigner{Origin: "origin.example.org", KeyID: "ed25519:test", Key: testSigningKey}
+	content := map[string]interface{}{"device_keys": map[string]interface{}{}}
+	resp, err := SignedRequest(signer, "dest.example.org", "POST", "/_matrix/federation/v1/user/keys/query", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req := resp.Request
+	if req.Host != "dest.example.org" {
+		t.Errorf("Expected host dest.example.org, got %s", req.Host)
+	}
+	if req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON content type, got %s", req.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != `{"device_keys":{}}` {
+		t.Errorf("Unexpected body: %s", body)
+	}
+	verifyAuthHeader(t, req.Header.Get("Authorization"), "POST", "dest.example.org", "/_matrix/federation/v1/user/keys/query", content)
+}
+
+func TestSignedRequest_DeniedServer(t *testing.T) {
+	client := &fakeHttpClient{responses: map[string]fakeResponse{}}
+	useFakes(t, &fakeResolver{ips: map[string][]string{"evil.example.org": {"198.51.100.7"}}}, client)
+
+	acl, err := NewServerAcl(nil, []string{"evil.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetServerAcl(acl)
+	defer SetServerAcl(nil)
+
+	signer := &RequestSigner{Origin: "origin.example.org", KeyID: "ed25519:test", Key: testSigningKey}
+	_, err = SignedRequest(signer, "evil.example.org", "GET", "/_matrix/federation/v1/version", nil)
+	var denied *ServerDeniedError
+	if !errors.As(err, &denied) {
+		t.Errorf("Expected the server to be denied, got %v", err)
+	}
+	if len(client.requests) != 0 {
+		t.Errorf("Expected no requests to a denied server, got %d", len(client.requests))
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Bounds on how long .well-known responses are cached for. The specification recommends
+// respecting the cache headers on the response, defaulting to 24 hours and capping at 48
+// hours, and caching errors for up to an hour.
+var (
+	WellKnownDefaultTtl = 24 * time.Hour
+	WellKnownMinTtl     = 5 * time.Minute
+	WellKnownMaxTtl     = 48 * time.Hour
+	WellKnownErrorTtl   = 1 * time.Hour
+)
+
+// WellKnownMaxBodySize is the largest .well-known response we're willing to read.
+var WellKnownMaxBodySize = int64(50 * 1024)
+
+const wellKnownMaxRedirects = 10
+
+type wellknownServerResponse struct {
+	ServerAddr string `json:"m.server"`
+}
+
+type wellKnownResult struct {
+	ServerAddr string
+	Err        error
+	ExpiresAt  time.Time
+	Cached     bool
+}
+
+var wellKnownCache = cache.New(cache.NoExpiration, 1*time.Hour)
+
+// fetchWellKnown looks up the delegated server name for a hostname, honouring the cache
+// headers of earlier responses.
+func fetchWellKnown(host string) *wellKnownResult {
+	if record, found := wellKnownCache.Get(host); found {
+		cached := *(record.(*wellKnownResult))
+		cached.Cached = true
+		return &cached
+	}
+
+	now := time.Now()
+	serverAddr, ttl, err := requestWellKnown(host, now)
+	if err != nil {
+		ttl = WellKnownErrorTtl
+	}
+
+	res := &wellKnownResult{
+		ServerAddr: serverAddr,
+		Err:        err,
+		ExpiresAt:  now.Add(ttl),
+	}
+	wellKnownCache.Set(host, res, ttl)
+	return res
+}
+
+func requestWellKnown(host string, now time.Time) (string, time.Duration, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/.well-known/matrix/server", host), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	r, err := wellKnownClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status code %d", r.StatusCode)
+	}
+
+	if r.ContentLength > WellKnownMaxBodySize {
+		return "", 0, fmt.Errorf("response is %d bytes, more than the limit of %d", r.ContentLength, WellKnownMaxBodySize)
+	}
+	c, err := ioutil.ReadAll(io.LimitReader(r.Body, WellKnownMaxBodySize+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if int64(len(c)) > WellKnownMaxBodySize {
+		return "", 0, fmt.Errorf("response is more than the limit of %d bytes", WellKnownMaxBodySize)
+	}
+
+	wk := &wellknownServerResponse{}
+	err = json.Unmarshal(c, wk)
+	if err != nil {
+		return "", 0, err
+	}
+	if wk.ServerAddr == "" {
+		return "", 0, errors.New("missing m.server")
+	}
+
+	return wk.ServerAddr, wellKnownTtl(r.Header, now), nil
+}
+
+// wellKnownTtl works out how long to cache a successful .well-known response for from its
+// Cache-Control and Expires headers, within the configured bounds.
+func wellKnownTtl(headers http.Header, now time.Time) time.Duration {
+	ttl := WellKnownDefaultTtl
+	found := false
+
+	for _, directive := range strings.Split(strings.Join(headers.Values("Cache-Control"), ","), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			ttl = 0
+			found = true
+			break
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.ParseInt(strings.Trim(directive[len("max-age="):], `"`), 10, 64)
+			if err == nil && seconds >= 0 {
+				ttl = WellKnownMaxTtl
+				if seconds < int64(WellKnownMaxTtl/time.Second) {
+					ttl = time.Duration(seconds) * time.Second
+				}
+				found = true
+			}
+		}
+	}
+
+	// Cache-Control wins over Expires
+	if !found && headers.Get("Expires") != "" {
+		expires, err := http.ParseTime(headers.Get("Expires"))
+		if err != nil {
+			// An invalid Expires header means the response has already expired
+			ttl = 0
+		} else {
+			ttl = expires.Sub(now)
+		}
+	}
+
+	if ttl < WellKnownMinTtl {
+		ttl = WellKnownMinTtl
+	}
+	if ttl > WellKnownMaxTtl {
+		ttl = WellKnownMaxTtl
+	}
+	return ttl
+}
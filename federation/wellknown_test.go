@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWellKnownTtl(t *testing.T) {
+	now := time.Date(2019, 7, 28, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		headers  map[string]string
+		expected time.Duration
+	}{
+		{"no headers", map[string]string{}, WellKnownDefaultTtl},
+		{"max-age", map[string]string{"Cache-Control": "public, max-age=7200"}, 2 * time.Hour},
+		{"max-age below minimum", map[string]string{"Cache-Control": "max-age=10"}, WellKnownMinTtl},
+		{"max-age above maximum", map[string]string{"Cache-Control": "max-age=999999999999"}, WellKnownMaxTtl},
+		{"no-store", map[string]string{"Cache-Control": "no-store"}, WellKnownMinTtl},
+		{"invalid max-age", map[string]string{"Cache-Control": "max-age=soon"}, WellKnownDefaultTtl},
+		{"expires", map[string]string{"Expires": now.Add(3 * time.Hour).Format(http.TimeFormat)}, 3 * time.Hour},
+		{"expires in the past", map[string]string{"Expires": now.Add(-3 * time.Hour).Format(http.TimeFormat)}, WellKnownMinTtl},
+		{"invalid expires", map[string]string{"Expires": "0"}, WellKnownMinTtl},
+		{"cache-control beats expires", map[string]string{"Cache-Control": "max-age=3600", "Expires": now.Add(10 * time.Hour).Format(http.TimeFormat)}, 1 * time.Hour},
+	}
+
+	for _, c := range cases {
+		headers := http.Header{}
+		for k, v := range c.headers {
+			headers.Set(k, v)
+		}
+		actual := wellKnownTtl(headers, now)
+		if actual != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, actual)
+		}
+	}
+}
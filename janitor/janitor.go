@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package janitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+type PruneCounts struct {
+	Servers         int64 `json:"servers"`
+	Keys            int64 `json:"keys"`
+	Signatures      int64 `json:"signatures"`
+	NotaryResponses int64 `json:"notary_responses"`
+	SeenSignatures  int64 `json:"seen_signatures"`
+}
+
+type Stats struct {
+	Runs           int64            `json:"runs"`
+	Failures       int64            `json:"failures"`
+	LastRunTs      models.Timestamp `json:"last_run_ts"`
+	LastDurationMs int64            `json:"last_duration_ms"`
+	LastRun        PruneCounts      `json:"last_run"`
+	Total          PruneCounts      `json:"total"`
+}
+
+var stats = &Stats{}
+var statsLock = &sync.Mutex{}
+
+// GetStats returns a copy of what the janitor has pruned so far.
+func GetStats() Stats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return *stats
+}
+
+// Start runs the janitor every interval in the background. Remote servers which have not
+// been requested or refreshed within maxAge are removed, unless they are pinned.
+func Start(interval time.Duration, maxAge time.Duration, pinned []models.ServerName) {
+	if interval <= 0 || maxAge <= 0 {
+		logrus.Info("Janitor is disabled")
+		return
+	}
+
+	logrus.Infof("Janitor will prune remote servers unused for %s every %s (%d pinned)", maxAge, interval, len(pinned))
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			RunOnce(maxAge, pinned)
+		}
+	}()
+}
+
+func RunOnce(maxAge time.Duration, pinned []models.ServerName) {
+	startTs := util.NowMillis()
+	cutoffTs := models.Timestamp(startTs - maxAge.Milliseconds())
+	counts := PruneCounts{}
+
+	err := prune(cutoffTs, pinned, &counts)
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	stats.Runs++
+	stats.LastRunTs = models.Timestamp(startTs)
+	stats.LastDurationMs = util.NowMillis() - startTs
+	stats.LastRun = counts
+	stats.Total.Servers += counts.Servers
+	stats.Total.Keys += counts.Keys
+	stats.Total.Signatures += counts.Signatures
+	stats.Total.NotaryResponses += counts.NotaryResponses
+	stats.Total.SeenSignatures += counts.SeenSignatures
+	if err != nil {
+		stats.Failures++
+		logrus.Error("Janitor failed: ", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"servers":          counts.Servers,
+		"keys":             counts.Keys,
+		"signatures":       counts.Signatures,
+		"notary_responses": counts.NotaryResponses,
+		"seen_signatures":  counts.SeenSignatures,
+	}).Info("Janitor finished pruning")
+}
+
+func prune(cutoffTs models.Timestamp, pinned []models.ServerName, counts *PruneCounts) error {
+	serverNames, err := db.GetUnusedRemoteServers(cutoffTs, pinned)
+	if err != nil {
+		return err
+	}
+
+	for _, serverName := range serverNames {
+		keyCount, sigCount, responseCount, err := db.DeleteRemoteServer(serverName)
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("Janitor pruned %s (%d keys, %d signatures)", serverName, keyCount, sigCount)
+		counts.Servers++
+		counts.Keys += keyCount
+		counts.Signatures += sigCount
+		counts.NotaryResponses += responseCount
+	}
+
+	// Cached notary responses for servers we still know about go stale too
+	responseCount, err := db.DeleteNotaryResponsesBefore(cutoffTs)
+	if err != nil {
+		return err
+	}
+	counts.NotaryResponses += responseCount
+
+	// Signatures remembered for replay protection are only needed until they expire
+	sigCount, err := db.DeleteSeenSignaturesBefore(models.Timestamp(util.NowMillis()))
+	if err != nil {
+		return err
+	}
+	counts.SeenSignatures += sigCount
+
+	return nil
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// EventReasonMissingSignature is used when a server which must sign an event didn't, and
+// EventReasonNotChecked for signatures skipped because of MaxOptionalEventSigners. Other
+// failures use the AuthReason constants.
+const (
+	EventReasonMissingSignature = "missing_signature"
+	EventReasonNotChecked       = "not_checked"
+)
+
+// MaxOptionalEventSigners is how many servers which didn't have to sign an event get their
+// signatures checked, on top of the required ones. Each needs its keys fetched.
+var MaxOptionalEventSigners = 3
+
+// EventServerResult is the outcome of checking one server's signature on an event. Required
+// servers must have signed the event for it to be accepted.
+type EventServerResult struct {
+	Required bool
+	Verified bool
+	KeyID    models.KeyID
+	Reason   string
+	Err      error
+}
+
+// EventVerification is the outcome of checking an event. An event whose signatures aren't valid
+// must be rejected, and one whose content hash doesn't match must be redacted before use.
+type EventVerification struct {
+	RoomVersion      *signing.RoomVersion
+	ReferenceHash    string
+	EventId          string
+	EventIdValid     *bool
+	ContentHashValid bool
+	Redact           bool
+	SignaturesValid  bool
+	Servers          map[string]*EventServerResult
+}
+
+// VerifyEvent checks an event's content hash and the signatures of every server which signed
+// it, using their keys as of the event's origin_server_ts. The event's ID is worked out from its
+// reference hash where the room version allows, and compared to expectedEventId (or the event's
+// own event_id) if given. An error is only returned if the event can't be checked at all, such
+// as when it is malformed.
+func VerifyEvent(event map[string]interface{}, roomVersionId string, expectedEventId string) (*EventVerification, error) {
+	roomVersion, err := signing.GetRoomVersion(roomVersionId)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, ok := event["origin_server_ts"].(float64)
+	if !ok || ts < 0 {
+		return nil, errors.New("origin_server_ts is missing or not a number")
+	}
+	// The sender picks origin_server_ts, so it can't make us look for keys from the future
+	originServerTs := models.Timestamp(ts)
+	if now := models.Timestamp(util.NowMillis()); originServerTs > now {
+		originServerTs = now
+	}
+
+	eventId, _ := event["event_id"].(string)
+	if roomVersion.EventIdFormat != signing.EventIdFormatV1 {
+		// The event ID is derived from the event in these room versions, so it isn't part
+		// of what was hashed and signed
+		withoutId := make(map[string]interface{}, len(event))
+		for k, v := range event {
+			withoutId[k] = v
+		}
+		delete(withoutId, "event_id")
+		event = withoutId
+	}
+
+	required, err := requiredEventSigners(event, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EventVerification{
+		RoomVersion: roomVersion,
+		Servers:     make(map[string]*EventServerResult),
+	}
+
+	referenceHash, err := signing.CalculateReferenceHash(event, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	result.ReferenceHash = signing.EncodeUnpaddedBase64ToString(referenceHash)
+
+	if roomVersion.EventIdFormat == signing.EventIdFormatV1 {
+		result.EventId = eventId
+	} else {
+		result.EventId, err = signing.CalculateEventId(event, roomVersion)
+		if err != nil {
+			return nil, err
+		}
+		if expectedEventId == "" {
+			expectedEventId = eventId
+		}
+	}
+	if expectedEventId != "" {
+		valid := expectedEventId == result.EventId
+		result.EventIdValid = &valid
+	}
+
+	// A missing or wrong content hash means the event must be redacted, not rejected
+	expectedHash := ""
+	if hashes, ok := event["hashes"].(map[string]interface{}); ok {
+		expectedHash, _ = hashes["sha256"].(string)
+	}
+	contentHash, err := signing.CalculateSha256ContentHash(event)
+	if err != nil {
+		return nil, err
+	}
+	result.ContentHashValid = expectedHash != "" && contentHash == expectedHash
+	result.Redact = !result.ContentHashValid
+
+	redacted, _, err := signing.RedactObject(event, roomVersion.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	signatures, _ := redacted["signatures"].(map[string]interface{})
+
+	for _, serverName := range required {
+		result.Servers[serverName] = &EventServerResult{Required: true}
+	}
+	optional := make([]string, 0, len(signatures))
+	for serverName := range signatures {
+		if _, ok := result.Servers[serverName]; !ok {
+			optional = append(optional, serverName)
+		}
+	}
+	sort.Strings(optional)
+	for i, serverName := range optional {
+		res := &EventServerResult{}
+		if i >= MaxOptionalEventSigners {
+			res.Reason = EventReasonNotChecked
+			res.Err = fmt.Errorf("only %d servers besides the required ones are checked", MaxOptionalEventSigners)
+		}
+		result.Servers[serverName] = res
+	}
+
+	// Key validity periods only apply from room version 5
+	keyTs := models.Timestamp(0)
+	if roomVersion.EnforceKeyValidity {
+		keyTs = originServerTs
+	}
+
+	result.SignaturesValid = true
+	for serverName, res := range result.Servers {
+		keySigs, _ := signatures[serverName].(map[string]interface{})
+		if res.Reason == EventReasonNotChecked {
+			continue
+		}
+		if len(keySigs) == 0 {
+			res.Reason = EventReasonMissingSignature
+			res.Err = fmt.Errorf("%s did not sign the event", serverName)
+		} else {
+			verifyEventSignature(redacted, serverName, keySigs, originServerTs, keyTs, res)
+		}
+		if res.Required && !res.Verified {
+			result.SignaturesValid = false
+		}
+	}
+
+	return result, nil
+}
+
+// requiredEventSigners lists the servers which must have signed an event: the sender's, the
+// event ID's for room versions which let the origin pick it, and the server which authorised
+// a restricted join.
+func requiredEventSigners(event map[string]interface{}, roomVersion *signing.RoomVersion) ([]string, error) {
+	required := make([]string, 0)
+
+	sender, _ := event["sender"].(string)
+	senderServer, err := serverNameOf(sender)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender: %v", err)
+	}
+	required = append(required, senderServer)
+
+	if roomVersion.EventIdFormat == signing.EventIdFormatV1 {
+		eventId, _ := event["event_id"].(string)
+		eventIdServer, err := serverNameOf(eventId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event_id: %v", err)
+		}
+		required = append(required, eventIdServer)
+	}
+
+	if roomVersion.RestrictedJoins && event["type"] == "m.room.member" {
+		content, _ := event["content"].(map[string]interface{})
+		if authorisedBy, ok := content["join_authorised_via_users_server"].(string); ok && content["membership"] == "join" {
+			authorisedServer, err := serverNameOf(authorisedBy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid join_authorised_via_users_server: %v", err)
+			}
+			required = append(required, authorisedServer)
+		}
+	}
+
+	return required, nil
+}
+
+// verifyEventSignature checks a server's signatures on a redacted event. One valid signature
+// is enough.
+func verifyEventSignature(redacted map[string]interface{}, serverName string, keySigs map[string]interface{}, originServerTs models.Timestamp, keyTs models.Timestamp, res *EventServerResult) {
+	o := getOriginKeys(serverName, originServerTs)
+	if o.err != nil {
+		res.Reason = o.err.Reason
+		res.Err = o.err.Err
+		return
+	}
+
+	keyIds := make([]string, 0, len(keySigs))
+	for keyId := range keySigs {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+
+	for _, keyId := range keyIds {
+		if _, ok := keySigs[keyId].(string); !ok {
+			res.Reason = AuthReasonBadSignature
+			res.Err = fmt.Errorf("signature by %s %s is not a string", serverName, keyId)
+			continue
+		}
+
+		publicKey, authErr := o.keyAt(serverName, keyId, keyTs)
+		if authErr != nil {
+			res.Reason = authErr.Reason
+			res.Err = authErr.Err
+			continue
+		}
+
+		obj := make(map[string]interface{}, len(redacted))
+		for k, v := range redacted {
+			obj[k] = v
+		}
+		obj["signatures"] = map[string]interface{}{
+			serverName: map[string]interface{}{keyId: keySigs[keyId]},
+		}
+		err := signing.VerifySignatures(obj, map[string]map[string]ed25519.PublicKey{
+			serverName: {keyId: publicKey},
+		})
+		if err != nil {
+			res.Reason = AuthReasonBadSignature
+			res.Err = err
+			continue
+		}
+
+		res.Verified = true
+		res.KeyID = models.KeyID(keyId)
+		res.Reason = ""
+		res.Err = nil
+		return
+	}
+}
+
+// serverNameOf returns the server name part of a user, room, or event ID.
+func serverNameOf(id string) (string, error) {
+	_, serverName, ok := strings.Cut(id, ":")
+	if !ok || serverName == "" {
+		return "", fmt.Errorf("%q has no server name", id)
+	}
+	return serverName, nil
+}
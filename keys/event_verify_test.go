@@ -0,0 +1,283 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/signing"
+)
+
+func TestRequiredEventSigners(t *testing.T) {
+	cases := []struct {
+		name        string
+		roomVersion string
+		event       map[string]interface{}
+		expected    []string
+	}{
+		{
+			name:        "sender only",
+			roomVersion: "10",
+			event:       map[string]interface{}{"sender": "@a:a.example.org", "event_id": "$x:b.example.org"},
+			expected:    []string{"a.example.org"},
+		},
+		{
+			name:        "event ID chosen by the origin",
+			roomVersion: "1",
+			event:       map[string]interface{}{"sender": "@a:a.example.org", "event_id": "$x:b.example.org"},
+			expected:    []string{"a.example.org", "b.example.org"},
+		},
+		{
+			name:        "restricted join",
+			roomVersion: "9",
+			event: map[string]interface{}{
+				"sender":  "@a:a.example.org",
+				"type":    "m.room.member",
+				"content": map[string]interface{}{"membership": "join", "join_authorised_via_users_server": "@c:c.example.org"},
+			},
+			expected: []string{"a.example.org", "c.example.org"},
+		},
+		{
+			name:        "restricted join before restricted rooms existed",
+			roomVersion: "7",
+			event: map[string]interface{}{
+				"sender":  "@a:a.example.org",
+				"type":    "m.room.member",
+				"content": map[string]interface{}{"membership": "join", "join_authorised_via_users_server": "@c:c.example.org"},
+			},
+			expected: []string{"a.example.org"},
+		},
+		{
+			name:        "authorising server on a leave",
+			roomVersion: "9",
+			event: map[string]interface{}{
+				"sender":  "@a:a.example.org",
+				"type":    "m.room.member",
+				"content": map[string]interface{}{"membership": "leave", "join_authorised_via_users_server": "@c:c.example.org"},
+			},
+			expected: []string{"a.example.org"},
+		},
+	}
+
+	for _, c := range cases {
+		roomVersion, err := signing.GetRoomVersion(c.roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		required, err := requiredEventSigners(c.event, roomVersion)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		sort.Strings(required)
+		if !reflect.DeepEqual(required, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, required)
+		}
+	}
+}
+
+func TestVerifyEvent(t *testing.T) {
+	denyAllServers(t)
+
+	event := map[string]interface{}{
+		"room_id":          "!r:a.example.org",
+		"sender":           "@a:a.example.org",
+		"origin_server_ts": float64(1000000),
+		"type":             "m.room.message",
+		"content":          map[string]interface{}{"body": "hello"},
+		"signatures": map[string]interface{}{
+			"b.example.org": map[string]interface{}{"ed25519:a": "AAAA"},
+		},
+	}
+	hash, err := signing.CalculateSha256ContentHash(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event["hashes"] = map[string]interface{}{"sha256": hash}
+
+	res, err := VerifyEvent(event, "10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.ContentHashValid || res.Redact {
+		t.Error("Expected the content hash to be valid")
+	}
+	if res.SignaturesValid {
+		t.Error("Expected the signatures to be invalid")
+	}
+	if s := res.Servers["a.example.org"]; s == nil || !s.Required || s.Reason != EventReasonMissingSignature {
+		t.Errorf("Expected the sender's server to be missing a signature, got %+v", s)
+	}
+	if s := res.Servers["b.example.org"]; s == nil || s.Required || s.Reason != AuthReasonServerDenied {
+		t.Errorf("Expected the other server to be denied, got %+v", s)
+	}
+
+	if res.EventIdValid != nil {
+		t.Error("Expected no event ID check without an expected ID")
+	}
+	eventId, err := signing.CalculateEventId(event, res.RoomVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.EventId != eventId {
+		t.Errorf("Expected event ID %s, got %s", eventId, res.EventId)
+	}
+
+	// The event's own event_id is checked when no expected ID is given
+	withId := make(map[string]interface{})
+	for k, v := range event {
+		withId[k] = v
+	}
+	withId["event_id"] = eventId
+	res, err = VerifyEvent(withId, "10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.EventIdValid == nil || !*res.EventIdValid {
+		t.Errorf("Expected the event's own event_id to be valid, got %v", res.EventIdValid)
+	}
+	for expected, valid := range map[string]bool{eventId: true, "$wrong": false} {
+		res, err = VerifyEvent(event, "10", expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.EventIdValid == nil || *res.EventIdValid != valid {
+			t.Errorf("Expected %s to be valid=%t, got %v", expected, valid, res.EventIdValid)
+		}
+	}
+
+	event["content"] = map[string]interface{}{"body": "changed"}
+	res, err = VerifyEvent(event, "10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ContentHashValid || !res.Redact {
+		t.Error("Expected a changed event to need redacting")
+	}
+
+	malformed := []struct {
+		name        string
+		roomVersion string
+		change      func(ev map[string]interface{})
+	}{
+		{"unknown room version", "999", func(ev map[string]interface{}) {}},
+		{"missing timestamp", "10", func(ev map[string]interface{}) { delete(ev, "origin_server_ts") }},
+		{"invalid sender", "10", func(ev map[string]interface{}) { ev["sender"] = "nobody" }},
+		{"content isn't an object", "10", func(ev map[string]interface{}) { ev["content"] = "hello" }},
+	}
+	for _, c := range malformed {
+		ev := make(map[string]interface{})
+		for k, v := range event {
+			ev[k] = v
+		}
+		c.change(ev)
+		if _, err = VerifyEvent(ev, c.roomVersion, ""); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func denyAllServers(t *testing.T) {
+	// Denying every server means no keys are fetched, so only the local checks run
+	acl, err := federation.NewServerAcl(nil, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	federation.SetServerAcl(acl)
+	t.Cleanup(func() {
+		federation.SetServerAcl(nil)
+	})
+}
+
+func TestVerifyEvent_IgnoresEventIdInNewRoomVersions(t *testing.T) {
+	denyAllServers(t)
+
+	event := map[string]interface{}{
+		"room_id":          "!r:a.example.org",
+		"sender":           "@a:a.example.org",
+		"origin_server_ts": float64(1000000),
+		"type":             "m.room.message",
+		"content":          map[string]interface{}{"body": "hello"},
+	}
+	hash, err := signing.CalculateSha256ContentHash(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event["hashes"] = map[string]interface{}{"sha256": hash}
+	event["event_id"] = "$added:a.example.org"
+
+	res, err := VerifyEvent(event, "10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.ContentHashValid {
+		t.Error("Expected event_id to be left out of the content hash")
+	}
+	if _, ok := event["event_id"]; !ok {
+		t.Error("Expected the caller's event to be left alone")
+	}
+}
+
+func TestVerifyEvent_LimitsOptionalSigners(t *testing.T) {
+	denyAllServers(t)
+
+	signatures := map[string]interface{}{
+		"a.example.org": map[string]interface{}{"ed25519:a": "AAAA"},
+	}
+	for i := 0; i < 10; i++ {
+		signatures[fmt.Sprintf("s%d.example.org", i)] = map[string]interface{}{"ed25519:a": "AAAA"}
+	}
+	event := map[string]interface{}{
+		"room_id":          "!r:a.example.org",
+		"sender":           "@a:a.example.org",
+		"origin_server_ts": float64(1000000),
+		"type":             "m.room.message",
+		"content":          map[string]interface{}{"body": "hello"},
+		"signatures":       signatures,
+	}
+
+	res, err := VerifyEvent(event, "10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Servers) != 11 {
+		t.Fatalf("Expected every signing server in the result, got %d", len(res.Servers))
+	}
+	if s := res.Servers["a.example.org"]; !s.Required || s.Reason != AuthReasonServerDenied {
+		t.Errorf("Expected the required server to be checked, got %+v", s)
+	}
+	checked := 0
+	for serverName, s := range res.Servers {
+		if s.Required {
+			continue
+		}
+		switch s.Reason {
+		case AuthReasonServerDenied:
+			checked++
+		case EventReasonNotChecked:
+		default:
+			t.Errorf("%s: unexpected reason %s", serverName, s.Reason)
+		}
+	}
+	if checked != MaxOptionalEventSigners {
+		t.Errorf("Expected %d optional servers to be checked, got %d", MaxOptionalEventSigners, checked)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+// FailedLookupTtl is how long a server which failed to answer is left alone before we try
+// contacting it again. Zero disables negative caching.
+var FailedLookupTtl = 10 * time.Minute
+
+// FailedLookup is why a server couldn't be reached. Attempts counts the lookups which have
+// failed in a row, including earlier ones whose failure has since expired.
+type FailedLookup struct {
+	ServerName models.ServerName `json:"server_name"`
+	Reason     string            `json:"reason"`
+	Kind       string            `json:"kind"`
+	Attempts   int               `json:"attempts"`
+	FailedTs   models.Timestamp  `json:"failed_ts"`
+	ExpiresTs  models.Timestamp  `json:"expires_ts"`
+
+	// The error is kept so later lookups fail the same way as the one which recorded it
+	err error
+}
+
+var failedLookups = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// failureCountTtl is how long a server's run of failures is remembered after the last one.
+// It outlives the failed lookup itself, as we only try again once that has expired.
+const failureCountTtl = 24 * time.Hour
+
+// consecutiveFailures counts the failed lookups of each server since it last answered.
+var consecutiveFailures = cache.New(failureCountTtl, 1*time.Hour)
+
+func GetFailedLookup(serverName models.ServerName) *FailedLookup {
+	if record, found := failedLookups.Get(string(serverName)); found {
+		return record.(*FailedLookup)
+	}
+	return nil
+}
+
+func recordFailedLookup(serverName models.ServerName, err error) {
+	if FailedLookupTtl <= 0 {
+		return
+	}
+
+	attempts := 1
+	if previous, found := consecutiveFailures.Get(string(serverName)); found {
+		attempts = previous.(int) + 1
+	}
+	consecutiveFailures.Set(string(serverName), attempts, failureCountTtl)
+
+	now := util.NowMillis()
+	failure := &FailedLookup{
+		ServerName: serverName,
+		Reason:     err.Error(),
+		Kind:       string(federation.Classify(err)),
+		Attempts:   attempts,
+		FailedTs:   models.Timestamp(now),
+		ExpiresTs:  models.Timestamp(now + FailedLookupTtl.Milliseconds()),
+		err:        err,
+	}
+	failedLookups.Set(string(serverName), failure, FailedLookupTtl)
+	logrus.WithField("reason", failure.Kind).Warnf("Caching failed lookup of %s for %s: %s", serverName, FailedLookupTtl, failure.Reason)
+}
+
+func clearFailedLookup(serverName models.ServerName) {
+	failedLookups.Delete(string(serverName))
+	consecutiveFailures.Delete(string(serverName))
+}
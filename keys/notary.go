@@ -18,7 +18,7 @@ package keys
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-key-server/api/api_models"
@@ -30,13 +30,40 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
+const lastRequestedResolution = int64(3600000) // 1 hour
+
+// MaxKeyResponseSize is the largest /_matrix/key/v2/server response we're willing to read.
+var MaxKeyResponseSize = int64(512 * 1024)
+
+// getRemoteServerMetadata is replaced in tests which don't have a database.
+var getRemoteServerMetadata = db.GetRemoteServerMetadata
+
+// saveRemoteKeys is replaced in tests which don't have a database.
+var saveRemoteKeys = storeRemoteKeys
+
 func QueryRemoteKeys(serverName models.ServerName, minValidUntilTs models.Timestamp) (*models.CachedRemoteKeys, error) {
-	s, err := db.GetRemoteServerMetadata(serverName)
+	// Nothing can be stored for a name we can't parse, and it isn't the remote server's fault
+	err := federation.ValidateServerName(string(serverName))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := getRemoteServerMetadata(serverName)
 	if err != nil {
 		return nil, err
 	}
 	if s != nil {
 		now := util.NowMillis()
+
+		// Keep the janitor away from servers people are still asking about. This doesn't
+		// need to be precise, so avoid writing on every request.
+		if now-int64(s.LastRequestedTs) > lastRequestedResolution {
+			err = db.MarkRemoteServerRequested(serverName, models.Timestamp(now))
+			if err != nil {
+				logrus.Warn("Failed to mark server as requested: ", err)
+			}
+		}
+
 		sevenDaysFromUpdate := int64(s.UpdatedTs) + int64(604800000)
 
 		isBeyondLifespan := now > sevenDaysFromUpdate
@@ -48,60 +75,69 @@ func QueryRemoteKeys(serverName models.ServerName, minValidUntilTs models.Timest
 		}
 	}
 
-	// Cache miss: fetch new keys
+	// Cache miss: fetch new keys, unless the server recently failed to answer us
+	if failure := GetFailedLookup(serverName); failure != nil {
+		logrus.Infof("Not contacting %s until %d due to an earlier failure: %s", serverName, failure.ExpiresTs, failure.Reason)
+		return packageDeadServer(s, failure.err)
+	}
+
 	// TODO: Rate limit: https://github.com/turt2live/matrix-key-server/issues/2
-	url, hostname, err := federation.GetServerApiUrl(string(serverName))
+	resolved, err := federation.ResolveServer(string(serverName))
 	if err != nil {
-		logrus.Error(err)
+		logrus.WithField("reason", federation.Classify(err)).Error(err)
+		recordFailedLookup(serverName, err)
+		return packageDeadServer(s, err)
+	}
 
-		if s != nil {
-			// Continue to serve the last known response from the dead server
-			return packageCachedKeysFor(s)
-		} else {
-			// else if the server is dead and we have no keys then return nothing back
-			return &models.CachedRemoteKeys{
-				Keys:       make([]*models.RemoteKey, 0),
-				Signatures: make([]*models.RemoteSignature, 0),
-				RemoteServer: &models.RemoteServer{
-					ServerName:   serverName,
-					ValidUntilTs: models.Timestamp(util.NowMillis()),
-					UpdatedTs:    models.Timestamp(util.NowMillis()),
-				},
-			}, nil
-		}
+	keyInfo, additionalFields, err := fetchRemoteKeys(resolved)
+	if err != nil {
+		recordFailedLookup(serverName, err)
+		return packageDeadServer(s, err)
 	}
 
-	keysUrl := url + "/_matrix/key/v2/server"
-	keysResponse, err := federation.FederatedGet(keysUrl, hostname)
+	clearFailedLookup(serverName)
+	return saveRemoteKeys(keyInfo, additionalFields)
+}
+
+func fetchRemoteKeys(resolved *federation.ResolvedServer) (api_models.ServerKeyResult, models.AdditionalJSON, error) {
+	keyInfo := api_models.ServerKeyResult{}
+
+	keysResponse, err := federation.FederatedRequest(resolved, "GET", "/_matrix/key/v2/server", nil, nil)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, err
 	}
 
-	c, err := ioutil.ReadAll(keysResponse.Body)
+	var c json.RawMessage
+	err = federation.DecodeJsonResponse(keysResponse, MaxKeyResponseSize, &c)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, err
 	}
 
-	keyInfo := api_models.ServerKeyResult{}
 	err = json.Unmarshal(c, &keyInfo)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, &federation.InvalidResponseError{Err: err}
+	}
+
+	// The keys are stored under the name in the response, so a server may only answer for itself
+	if keyInfo.ServerName != resolved.ServerName {
+		err = fmt.Errorf("asked %s for its keys but got keys for %q", resolved.ServerName, keyInfo.ServerName)
+		return keyInfo, nil, &federation.InvalidResponseError{Err: err}
 	}
 
 	publicKeys, err := grabPublicKeys(keyInfo)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, &federation.InvalidResponseError{Err: err}
 	}
 
 	additionalFields := models.AdditionalJSON{}
 	fullyUnmarshalled := make(map[string]interface{})
 	err = json.Unmarshal(c, &fullyUnmarshalled)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, &federation.InvalidResponseError{Err: err}
 	}
 	m, err := util.InterfaceToMap(keyInfo)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, err
 	}
 	for k, v := range fullyUnmarshalled {
 		if _, ok := m[k]; !ok {
@@ -112,10 +148,20 @@ func QueryRemoteKeys(serverName models.ServerName, minValidUntilTs models.Timest
 
 	err = signing.VerifySignatures(m, publicKeys)
 	if err != nil {
-		return nil, err
+		return keyInfo, nil, &federation.InvalidSignatureError{Err: err}
 	}
 
-	return storeRemoteKeys(keyInfo, additionalFields)
+	return keyInfo, additionalFields, nil
+}
+
+// packageDeadServer decides what to answer with when a server can't be reached, whether we
+// just tried or it failed recently: the last keys we had for it, or the error if there are none.
+func packageDeadServer(s *models.RemoteServer, err error) (*models.CachedRemoteKeys, error) {
+	if s != nil {
+		// Continue to serve the last known response from the dead server
+		return packageCachedKeysFor(s)
+	}
+	return nil, err
 }
 
 func packageCachedKeysFor(server *models.RemoteServer) (*models.CachedRemoteKeys, error) {
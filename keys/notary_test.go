@@ -0,0 +1,235 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/api/api_models"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/signing"
+	"golang.org/x/crypto/ed25519"
+)
+
+type failingClient struct {
+	requests int
+	lock     sync.Mutex
+}
+
+func (c *failingClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests++
+	return nil, errors.New("connection refused")
+}
+
+func TestQueryRemoteKeys_ConsecutiveFailures(t *testing.T) {
+	client := &failingClient{}
+	federation.SetFederationClientFactory(func(tlsServerName string) federation.HttpClient {
+		return client
+	})
+	getRemoteServerMetadata = func(serverName models.ServerName) (*models.RemoteServer, error) {
+		return nil, nil
+	}
+	serverName := models.ServerName("192.0.2.1:8448")
+	t.Cleanup(func() {
+		federation.SetFederationClientFactory(nil)
+		getRemoteServerMetadata = db.GetRemoteServerMetadata
+		clearFailedLookup(serverName)
+	})
+
+	for i := 0; i < 2; i++ {
+		keys, err := QueryRemoteKeys(serverName, 0)
+		if keys != nil {
+			t.Errorf("%d: expected no keys, got %+v", i, keys)
+		}
+		unreachable := &federation.UnreachableError{}
+		if !errors.As(err, &unreachable) {
+			t.Errorf("%d: expected the server to be unreachable, got %v", i, err)
+		}
+	}
+
+	if client.requests != 1 {
+		t.Errorf("Expected the failure to be remembered after 1 request, got %d", client.requests)
+	}
+	if failure := GetFailedLookup(serverName); failure == nil || failure.Attempts != 1 {
+		t.Errorf("Expected 1 recorded failure, got %+v", failure)
+	}
+
+	// Once the failure expires the server is tried again, and the count carries on
+	failedLookups.Delete(string(serverName))
+	_, _ = QueryRemoteKeys(serverName, 0)
+	if client.requests != 2 {
+		t.Errorf("Expected the server to be tried again, got %d requests", client.requests)
+	}
+	if failure := GetFailedLookup(serverName); failure == nil || failure.Attempts != 2 {
+		t.Errorf("Expected 2 recorded failures, got %+v", failure)
+	}
+
+	// An answer starts the count again
+	clearFailedLookup(serverName)
+	recordFailedLookup(serverName, errors.New("connection refused"))
+	if failure := GetFailedLookup(serverName); failure == nil || failure.Attempts != 1 {
+		t.Errorf("Expected the count to restart, got %+v", failure)
+	}
+}
+
+type trackedBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type staticClient struct {
+	status int
+	body   string
+	bodies []*trackedBody
+	lock   sync.Mutex
+}
+
+func (c *staticClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := &trackedBody{Reader: strings.NewReader(c.body)}
+	c.bodies = append(c.bodies, b)
+	return &http.Response{
+		StatusCode: c.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       b,
+	}, nil
+}
+
+func TestFetchRemoteKeys_ClosesBody(t *testing.T) {
+	t.Cleanup(func() {
+		federation.SetFederationClientFactory(nil)
+	})
+
+	cases := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"error status", 500, `{"errcode":"M_UNKNOWN"}`},
+		{"invalid json", 200, `{"server_name":`},
+		{"unsigned keys", 200, `{"server_name":"192.0.2.1:8448","valid_until_ts":1,"verify_keys":{}}`},
+	}
+	for _, c := range cases {
+		client := &staticClient{status: c.status, body: c.body}
+		federation.SetFederationClientFactory(func(tlsServerName string) federation.HttpClient {
+			return client
+		})
+
+		resolved := &federation.ResolvedServer{
+			ServerName:    "192.0.2.1:8448",
+			HostHeader:    "192.0.2.1:8448",
+			TlsServerName: "192.0.2.1",
+			Targets:       []federation.Target{{Host: "192.0.2.1", Port: "8448"}},
+		}
+		_, _, err := fetchRemoteKeys(resolved)
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if len(client.bodies) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", c.name, len(client.bodies))
+		}
+		if !client.bodies[0].closed {
+			t.Errorf("%s: expected the response body to be closed", c.name)
+		}
+	}
+}
+
+func TestQueryRemoteKeys_RejectsOtherServerName(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signing.SignObject(map[string]interface{}{
+		"server_name":     "matrix.org",
+		"valid_until_ts":  4102444800000,
+		"old_verify_keys": map[string]interface{}{},
+		"verify_keys": map[string]interface{}{
+			"ed25519:a": map[string]interface{}{"key": signing.EncodeUnpaddedBase64ToString(pub)},
+		},
+	}, "matrix.org", "ed25519:a", priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &staticClient{status: 200, body: string(body)}
+	federation.SetFederationClientFactory(func(tlsServerName string) federation.HttpClient {
+		return client
+	})
+	getRemoteServerMetadata = func(serverName models.ServerName) (*models.RemoteServer, error) {
+		return nil, nil
+	}
+	stored := false
+	saveRemoteKeys = func(keyInfo api_models.ServerKeyResult, additionalJson models.AdditionalJSON) (*models.CachedRemoteKeys, error) {
+		stored = true
+		return nil, errors.New("keys should not be stored")
+	}
+	serverName := models.ServerName("192.0.2.1:8448")
+	t.Cleanup(func() {
+		federation.SetFederationClientFactory(nil)
+		getRemoteServerMetadata = db.GetRemoteServerMetadata
+		saveRemoteKeys = storeRemoteKeys
+		clearFailedLookup(serverName)
+	})
+
+	keys, err := QueryRemoteKeys(serverName, 0)
+	if keys != nil {
+		t.Errorf("Expected no keys, got %+v", keys)
+	}
+	invalid := &federation.InvalidResponseError{}
+	if !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid response, got %v", err)
+	}
+	if stored {
+		t.Error("Expected keys for another server not to be stored")
+	}
+}
+
+func TestQueryRemoteKeys_InvalidServerName(t *testing.T) {
+	serverName := models.ServerName("a:b:c")
+	t.Cleanup(func() {
+		clearFailedLookup(serverName)
+	})
+
+	_, err := QueryRemoteKeys(serverName, 0)
+	invalid := &federation.InvalidServerNameError{}
+	if !errors.As(err, &invalid) {
+		t.Errorf("Expected an invalid server name, got %v", err)
+	}
+	if failure := GetFailedLookup(serverName); failure != nil {
+		t.Errorf("Expected no failure to be recorded, got %+v", failure)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+// ReplayWindow is how long a signature which authorized a request is remembered for, during
+// which requests with the same signature are rejected. Zero disables replay protection.
+var ReplayWindow = time.Duration(0)
+
+// ReplayUseDatabase additionally remembers signatures in the database so replays are caught
+// across key server processes.
+var ReplayUseDatabase = false
+
+var seenSignatures = cache.New(5*time.Minute, 10*time.Minute)
+
+// markSignatureSeenInDb is replaced in tests which don't have a database.
+var markSignatureSeenInDb = db.MarkSignatureSeen
+
+// markSignatureSeen records that a signature authorized a request, returning false if it was
+// already used within the replay window.
+func markSignatureSeen(origin string, signature string) (bool, error) {
+	if ReplayWindow <= 0 {
+		return true, nil
+	}
+
+	// The same signature can be written more than one way in unpadded base64
+	b, err := signing.DecodeUnpaddedBase64String(signature)
+	if err != nil {
+		return false, err
+	}
+	signature = signing.EncodeUnpaddedBase64ToString(b)
+
+	key := origin + "|" + signature
+	if err = seenSignatures.Add(key, true, ReplayWindow); err != nil {
+		return false, nil
+	}
+
+	if ReplayUseDatabase {
+		nowTs := util.NowMillis()
+		fresh, err := markSignatureSeenInDb(origin, signature, models.Timestamp(nowTs+ReplayWindow.Milliseconds()), models.Timestamp(nowTs))
+		if err != nil {
+			// The signature wasn't recorded, so a retry of the same request isn't a replay
+			seenSignatures.Delete(key)
+			return false, err
+		}
+		return fresh, nil
+	}
+	return true, nil
+}
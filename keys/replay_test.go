@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/t2bot/matrix-key-server/db"
+	"github.com/t2bot/matrix-key-server/db/models"
+)
+
+func TestMarkSignatureSeen(t *testing.T) {
+	ReplayWindow = 0
+	for i := 0; i < 2; i++ {
+		if fresh, err := markSignatureSeen("a.example.org", "AAAA"); err != nil || !fresh {
+			t.Fatalf("Expected signatures to always be fresh when disabled, got %t %v", fresh, err)
+		}
+	}
+
+	ReplayWindow = 1 * time.Minute
+	t.Cleanup(func() {
+		ReplayWindow = 0
+		seenSignatures.Flush()
+	})
+
+	cases := []struct {
+		name      string
+		origin    string
+		signature string
+		fresh     bool
+	}{
+		{"first use", "a.example.org", "AAAA", true},
+		{"replayed", "a.example.org", "AAAA", false},
+		{"different origin", "b.example.org", "AAAA", true},
+		{"different signature", "a.example.org", "BBA", true},
+		// "BBA" and "BBB" decode to the same bytes: the trailing bits are ignored
+		{"same signature written differently", "a.example.org", "BBB", false},
+	}
+	for _, c := range cases {
+		fresh, err := markSignatureSeen(c.origin, c.signature)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if fresh != c.fresh {
+			t.Errorf("%s: expected fresh=%t, got %t", c.name, c.fresh, fresh)
+		}
+	}
+
+	if _, err := markSignatureSeen("a.example.org", "not base64!"); err == nil {
+		t.Error("Expected an error for a signature which isn't base64")
+	}
+}
+
+func TestMarkSignatureSeen_DatabaseFailure(t *testing.T) {
+	ReplayWindow = 1 * time.Minute
+	ReplayUseDatabase = true
+	dbErr := errors.New("database unavailable")
+	markSignatureSeenInDb = func(origin string, signature string, expiresTs models.Timestamp, nowTs models.Timestamp) (bool, error) {
+		return false, dbErr
+	}
+	t.Cleanup(func() {
+		ReplayWindow = 0
+		ReplayUseDatabase = false
+		markSignatureSeenInDb = db.MarkSignatureSeen
+		seenSignatures.Flush()
+	})
+
+	if _, err := markSignatureSeen("a.example.org", "AAAA"); !errors.Is(err, dbErr) {
+		t.Fatalf("Expected the database error, got %v", err)
+	}
+
+	// Once the database is back, a retry of the same request goes through
+	markSignatureSeenInDb = func(origin string, signature string, expiresTs models.Timestamp, nowTs models.Timestamp) (bool, error) {
+		return true, nil
+	}
+	if fresh, err := markSignatureSeen("a.example.org", "AAAA"); err != nil || !fresh {
+		t.Errorf("Expected the retry to be fresh, got %t %v", fresh, err)
+	}
+	if fresh, err := markSignatureSeen("a.example.org", "AAAA"); err != nil || fresh {
+		t.Errorf("Expected a second use to be a replay, got %t %v", fresh, err)
+	}
+}
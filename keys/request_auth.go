@@ -0,0 +1,275 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+	"github.com/t2bot/matrix-key-server/xmatrix"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Reasons a signed request can fail verification.
+const (
+	AuthReasonInvalidHeader       = "invalid_header"
+	AuthReasonInvalidContent      = "invalid_content"
+	AuthReasonOriginMismatch      = "origin_mismatch"
+	AuthReasonDestinationMismatch = "destination_mismatch"
+	AuthReasonServerDenied        = "server_denied"
+	AuthReasonKeysUnavailable     = "keys_unavailable"
+	AuthReasonUnknownKey          = "unknown_key"
+	AuthReasonExpiredKey          = "expired_key"
+	AuthReasonBadSignature        = "bad_signature"
+	AuthReasonReplayed            = "replayed"
+	AuthReasonReplayCheckFailed   = "replay_check_failed"
+)
+
+type AuthError struct {
+	Reason string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// SignedRequest describes a federation request whose X-Matrix signatures need checking.
+// Origin is optional: if set, the Authorization headers must agree with it. Destination is
+// the server the request was sent to, defaulting to SelfDomainName, and must be set from
+// something the caller trusts rather than from the request's own headers. Content is the
+// request's body exactly as received: an empty body means the request had no content, and
+// anything else must be valid JSON. The signing key must be valid at RequestTs, which
+// defaults to now.
+type SignedRequest struct {
+	Method        string
+	Uri           string
+	Origin        string
+	Destination   string
+	Content       []byte
+	Authorization []string
+	RequestTs     models.Timestamp
+}
+
+type VerifiedRequest struct {
+	Origin string
+	KeyID  models.KeyID
+}
+
+type originKey struct {
+	key          ed25519.PublicKey
+	validUntilTs models.Timestamp
+}
+
+type originKeys struct {
+	keys         map[string]*originKey
+	validUntilTs models.Timestamp
+	err          *AuthError
+}
+
+// VerifyRequest checks the X-Matrix signatures on a request against the origin's keys. Every
+// Authorization header must be from the same origin, and one valid signature is enough.
+// Failures are returned as an *AuthError.
+func VerifyRequest(req *SignedRequest) (*VerifiedRequest, error) {
+	verified, err := verifyRequest(req, make(map[string]*originKeys))
+	if err != nil {
+		// Avoid returning a typed nil as a non-nil error
+		return nil, err
+	}
+	return verified, nil
+}
+
+// VerifyRequests checks many requests at once, as VerifyRequest does, fetching each origin's
+// keys only once. The results are in the same order as the requests.
+func VerifyRequests(reqs []*SignedRequest) ([]*VerifiedRequest, []error) {
+	verified := make([]*VerifiedRequest, len(reqs))
+	errs := make([]error, len(reqs))
+	cache := make(map[string]*originKeys)
+	for i, req := range reqs {
+		v, err := verifyRequest(req, cache)
+		verified[i] = v
+		if err != nil {
+			errs[i] = err
+		}
+	}
+	return verified, errs
+}
+
+func verifyRequest(req *SignedRequest, cache map[string]*originKeys) (*VerifiedRequest, *AuthError) {
+	auths, err := xmatrix.ParseAll(req.Authorization)
+	if err != nil {
+		return nil, &AuthError{AuthReasonInvalidHeader, err}
+	}
+
+	// The destination is never taken from the headers: a request signed for another server
+	// mustn't be accepted here.
+	destination := req.Destination
+	if destination == "" {
+		destination = SelfDomainName
+	}
+
+	origin := auths[0].Origin
+	for _, auth := range auths {
+		if req.Origin != "" && auth.Origin != req.Origin {
+			return nil, &AuthError{AuthReasonOriginMismatch, fmt.Errorf("authorization is from %s, expected %s", auth.Origin, req.Origin)}
+		}
+		if auth.Origin != origin {
+			return nil, &AuthError{AuthReasonOriginMismatch, fmt.Errorf("authorization is from %s, expected %s", auth.Origin, origin)}
+		}
+		if auth.Destination != "" && auth.Destination != destination {
+			return nil, &AuthError{AuthReasonDestinationMismatch, fmt.Errorf("authorization is for %s, not %s", auth.Destination, destination)}
+		}
+	}
+
+	// Per the specification, content is only signed when there is a body. A body we can't
+	// parse can't have been signed, so it doesn't get treated as no content.
+	var content interface{}
+	hasContent := len(req.Content) > 0
+	if hasContent {
+		err = json.Unmarshal(req.Content, &content)
+		if err != nil {
+			return nil, &AuthError{AuthReasonInvalidContent, err}
+		}
+	}
+
+	requestTs := req.RequestTs
+	if requestTs <= 0 {
+		requestTs = models.Timestamp(util.NowMillis())
+	}
+
+	// Keys fetched for an earlier request in a batch may not last long enough for this one
+	o, ok := cache[origin]
+	if !ok || (o.err == nil && o.validUntilTs < requestTs) {
+		o = getOriginKeys(origin, requestTs)
+		cache[origin] = o
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	var lastErr *AuthError
+	for _, auth := range auths {
+		publicKey, authErr := o.keyAt(origin, auth.KeyID, requestTs)
+		if authErr != nil {
+			lastErr = authErr
+			continue
+		}
+
+		obj := map[string]interface{}{
+			"method":      req.Method,
+			"uri":         req.Uri,
+			"origin":      origin,
+			"destination": destination,
+			"signatures": map[string]interface{}{
+				origin: map[string]interface{}{
+					auth.KeyID: auth.Signature,
+				},
+			},
+		}
+		if hasContent {
+			obj["content"] = content
+		}
+
+		err = signing.VerifySignatures(obj, map[string]map[string]ed25519.PublicKey{
+			origin: {auth.KeyID: publicKey},
+		})
+		if err != nil {
+			logrus.Warnf("Signature by %s %s did not verify: %v", origin, auth.KeyID, err)
+			lastErr = &AuthError{AuthReasonBadSignature, err}
+			continue
+		}
+
+		fresh, err := markSignatureSeen(origin, auth.Signature)
+		if err != nil {
+			return nil, &AuthError{AuthReasonReplayCheckFailed, err}
+		}
+		if !fresh {
+			return nil, &AuthError{AuthReasonReplayed, fmt.Errorf("signature by %s %s was already used", origin, auth.KeyID)}
+		}
+
+		return &VerifiedRequest{Origin: origin, KeyID: models.KeyID(auth.KeyID)}, nil
+	}
+
+	return nil, lastErr
+}
+
+// getOriginKeys fetches an origin's keys, making sure they're fresh enough to check a request
+// made at requestTs.
+func getOriginKeys(origin string, requestTs models.Timestamp) *originKeys {
+	err := federation.CheckServerAllowed(origin)
+	if err != nil {
+		return &originKeys{err: &AuthError{AuthReasonServerDenied, err}}
+	}
+
+	validKeys, err := QueryRemoteKeys(models.ServerName(origin), requestTs)
+	if err != nil {
+		return &originKeys{err: &AuthError{AuthReasonKeysUnavailable, err}}
+	}
+
+	o, err := newOriginKeys(origin, validKeys)
+	if err != nil {
+		return &originKeys{err: &AuthError{AuthReasonKeysUnavailable, err}}
+	}
+	return o
+}
+
+// newOriginKeys works out until when each of a server's keys is valid: current keys are valid
+// until the response they came in expires, and old keys until they expired. The keys must
+// belong to origin.
+func newOriginKeys(origin string, cached *models.CachedRemoteKeys) (*originKeys, error) {
+	if string(cached.ServerName) != origin {
+		return nil, fmt.Errorf("expected keys for %s, got keys for %s", origin, cached.ServerName)
+	}
+
+	o := &originKeys{
+		keys:         make(map[string]*originKey),
+		validUntilTs: cached.ValidUntilTs,
+	}
+	for _, k := range cached.Keys {
+		b, err := signing.DecodeUnpaddedBase64String(string(k.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+
+		validUntilTs := cached.ValidUntilTs
+		if k.ExpiresTs > 0 {
+			validUntilTs = k.ExpiresTs
+		}
+		o.keys[string(k.ID)] = &originKey{key: ed25519.PublicKey(b), validUntilTs: validUntilTs}
+	}
+	return o, nil
+}
+
+func (o *originKeys) keyAt(origin string, keyId string, ts models.Timestamp) (ed25519.PublicKey, *AuthError) {
+	k, ok := o.keys[keyId]
+	if !ok {
+		return nil, &AuthError{AuthReasonUnknownKey, fmt.Errorf("%s has no key %s", origin, keyId)}
+	}
+	if k.validUntilTs < ts {
+		return nil, &AuthError{AuthReasonExpiredKey, fmt.Errorf("%s key %s is only valid until %d, not %d", origin, keyId, k.validUntilTs, ts)}
+	}
+	return k.key, nil
+}
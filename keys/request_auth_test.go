@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifyRequest_RejectsBeforeFetchingKeys(t *testing.T) {
+	acl, err := federation.NewServerAcl(nil, []string{"denied.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	federation.SetServerAcl(acl)
+	t.Cleanup(func() {
+		federation.SetServerAcl(nil)
+	})
+
+	cases := []struct {
+		name   string
+		req    *SignedRequest
+		reason string
+	}{
+		{
+			name:   "no authorization",
+			req:    &SignedRequest{Method: "GET", Uri: "/"},
+			reason: AuthReasonInvalidHeader,
+		},
+		{
+			name:   "malformed authorization",
+			req:    &SignedRequest{Method: "GET", Uri: "/", Authorization: []string{`X-Matrix origin="a.example.org"`}},
+			reason: AuthReasonInvalidHeader,
+		},
+		{
+			name: "origins disagree",
+			req: &SignedRequest{Method: "GET", Uri: "/", Authorization: []string{
+				`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+				`X-Matrix origin="b.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonOriginMismatch,
+		},
+		{
+			name: "unexpected origin",
+			req: &SignedRequest{Method: "GET", Uri: "/", Origin: "b.example.org", Authorization: []string{
+				`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonOriginMismatch,
+		},
+		{
+			name: "unexpected destination",
+			req: &SignedRequest{Method: "GET", Uri: "/", Destination: "us.example.org", Authorization: []string{
+				`X-Matrix origin="a.example.org",destination="them.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonDestinationMismatch,
+		},
+		{
+			name: "body which isn't JSON",
+			req: &SignedRequest{Method: "PUT", Uri: "/", Content: []byte(`{"not json`), Authorization: []string{
+				`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonInvalidContent,
+		},
+		{
+			name: "body of whitespace",
+			req: &SignedRequest{Method: "PUT", Uri: "/", Content: []byte("  \n"), Authorization: []string{
+				`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonInvalidContent,
+		},
+		{
+			name: "body with trailing garbage",
+			req: &SignedRequest{Method: "PUT", Uri: "/", Content: []byte(`{"a":1} trailing`), Authorization: []string{
+				`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonInvalidContent,
+		},
+		{
+			name: "denied origin",
+			req: &SignedRequest{Method: "GET", Uri: "/", Authorization: []string{
+				`X-Matrix origin="denied.example.org",key="ed25519:a",sig="AAA"`,
+			}},
+			reason: AuthReasonServerDenied,
+		},
+	}
+
+	for _, c := range cases {
+		_, err := VerifyRequest(c.req)
+		authErr := &AuthError{}
+		if !errors.As(err, &authErr) {
+			t.Errorf("%s: expected an AuthError, got %v", c.name, err)
+			continue
+		}
+		if authErr.Reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %s", c.name, c.reason, authErr.Reason)
+		}
+	}
+}
+
+func TestVerifyRequests_ResultsInOrder(t *testing.T) {
+	acl, err := federation.NewServerAcl(nil, []string{"denied.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	federation.SetServerAcl(acl)
+	t.Cleanup(func() {
+		federation.SetServerAcl(nil)
+	})
+
+	reqs := []*SignedRequest{
+		{Method: "GET", Uri: "/a", Authorization: []string{`X-Matrix origin="denied.example.org",key="ed25519:a",sig="AAA"`}},
+		{Method: "GET", Uri: "/b"},
+		{Method: "GET", Uri: "/c", Authorization: []string{`X-Matrix origin="denied.example.org",key="ed25519:b",sig="BBB"`}},
+	}
+	verified, errs := VerifyRequests(reqs)
+	if len(verified) != 3 || len(errs) != 3 {
+		t.Fatalf("Expected 3 results, got %d and %d", len(verified), len(errs))
+	}
+
+	expected := []string{AuthReasonServerDenied, AuthReasonInvalidHeader, AuthReasonServerDenied}
+	for i, reason := range expected {
+		if verified[i] != nil {
+			t.Errorf("%d: expected no verification", i)
+		}
+		authErr := &AuthError{}
+		if !errors.As(errs[i], &authErr) || authErr.Reason != reason {
+			t.Errorf("%d: expected reason %s, got %v", i, reason, errs[i])
+		}
+	}
+}
+
+func TestOriginKeys_ValidAtRequestTime(t *testing.T) {
+	cached := &models.CachedRemoteKeys{
+		RemoteServer: &models.RemoteServer{ServerName: "example.org", ValidUntilTs: 2000},
+		Keys: []*models.RemoteKey{
+			{ServerName: "example.org", ID: "ed25519:current", PublicKey: "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw"},
+			{ServerName: "example.org", ID: "ed25519:old", PublicKey: "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw", ExpiresTs: 1000},
+		},
+	}
+	o, err := newOriginKeys("example.org", cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		keyId  string
+		ts     models.Timestamp
+		reason string
+	}{
+		{"ed25519:current", 1500, ""},
+		{"ed25519:current", 2000, ""},
+		{"ed25519:current", 2001, AuthReasonExpiredKey},
+		{"ed25519:old", 999, ""},
+		{"ed25519:old", 1000, ""},
+		{"ed25519:old", 1500, AuthReasonExpiredKey},
+		{"ed25519:missing", 1500, AuthReasonUnknownKey},
+	}
+	for _, c := range cases {
+		_, authErr := o.keyAt("example.org", c.keyId, c.ts)
+		reason := ""
+		if authErr != nil {
+			reason = authErr.Reason
+		}
+		if reason != c.reason {
+			t.Errorf("%s at %d: expected %q, got %q", c.keyId, c.ts, c.reason, reason)
+		}
+	}
+
+	cached.Keys[0].PublicKey = "not base64!"
+	if _, err = newOriginKeys("example.org", cached); err == nil {
+		t.Error("Expected an error for an invalid public key")
+	}
+
+	cached.Keys[0].PublicKey = "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw"
+	if _, err = newOriginKeys("other.example.org", cached); err == nil {
+		t.Error("Expected an error for keys belonging to another server")
+	}
+}
+
+func TestVerifyRequest_DestinationIsTrusted(t *testing.T) {
+	previous := SelfDomainName
+	SelfDomainName = "us.example.org"
+	t.Cleanup(func() {
+		SelfDomainName = previous
+	})
+
+	key := ed25519.NewKeyFromSeed([]byte("00000000000000000000000000000000"))
+	signer := &federation.RequestSigner{Origin: "a.example.org", KeyID: "ed25519:a", Key: key}
+
+	// The origin's keys are already known, so nothing needs fetching
+	knownKeys := func() map[string]*originKeys {
+		validUntilTs := models.Timestamp(util.NowMillis() + 3600000)
+		return map[string]*originKeys{
+			"a.example.org": {
+				keys:         map[string]*originKey{"ed25519:a": {key: key.Public().(ed25519.PublicKey), validUntilTs: validUntilTs}},
+				validUntilTs: validUntilTs,
+			},
+		}
+	}
+
+	cases := []struct {
+		name        string
+		signedFor   string
+		destination string
+		reason      string
+	}{
+		{"signed for us", "us.example.org", "", ""},
+		{"signed for the given destination", "other.example.org", "other.example.org", ""},
+		{"signed for another server", "other.example.org", "", AuthReasonDestinationMismatch},
+		{"signed for us, given another destination", "us.example.org", "other.example.org", AuthReasonDestinationMismatch},
+	}
+	for _, c := range cases {
+		auth, err := signer.AuthorizationHeader("GET", c.signedFor, "/_matrix/federation/v1/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &SignedRequest{
+			Method:        "GET",
+			Uri:           "/_matrix/federation/v1/version",
+			Destination:   c.destination,
+			Authorization: []string{auth},
+		}
+
+		_, authErr := verifyRequest(req, knownKeys())
+		reason := ""
+		if authErr != nil {
+			reason = authErr.Reason
+		}
+		if reason != c.reason {
+			t.Errorf("%s: expected %q, got %v", c.name, c.reason, authErr)
+		}
+	}
+}
+
+func TestVerifyRequest_OriginMismatchNamesExpectedOrigin(t *testing.T) {
+	req := &SignedRequest{Method: "GET", Uri: "/", Origin: "b.example.org", Authorization: []string{
+		`X-Matrix origin="a.example.org",key="ed25519:a",sig="AAA"`,
+	}}
+	_, authErr := verifyRequest(req, make(map[string]*originKeys))
+	if authErr == nil || authErr.Reason != AuthReasonOriginMismatch {
+		t.Fatalf("Expected an origin mismatch, got %v", authErr)
+	}
+	expected := "authorization is from a.example.org, expected b.example.org"
+	if authErr.Err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, authErr.Err.Error())
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-key-server/db"
 	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/federation"
 	"github.com/t2bot/matrix-key-server/signing"
 	"github.com/t2bot/matrix-key-server/util"
 	"golang.org/x/crypto/ed25519"
@@ -103,6 +104,21 @@ func GetSelfKey() (*SelfKey, error) {
 	return ownKey, nil
 }
 
+// GetRequestSigner returns a signer which authenticates outbound federation requests as this
+// server, using its preferred key.
+func GetRequestSigner() (*federation.RequestSigner, error) {
+	key, err := GetSelfKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &federation.RequestSigner{
+		Origin: SelfDomainName,
+		KeyID:  key.ID,
+		Key:    key.Priv,
+	}, nil
+}
+
 func LoadKey(key *models.OwnKey) (*SelfKey, error) {
 	pubDecoded, err := signing.DecodeUnpaddedBase64String(string(key.PublicKey))
 	if err != nil {
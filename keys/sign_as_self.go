@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/t2bot/matrix-key-server/db/models"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+)
+
+// SignObjectsAllowed enables SignObjectAsSelf. Signing arbitrary JSON is off by default because
+// it hands callers a lot of this server's authority.
+var SignObjectsAllowed = false
+
+// refusedObjectKeys are top level keys of objects which would let a caller pass themselves off
+// as this server over federation: key responses, signed requests, and events.
+var refusedObjectKeys = []string{"verify_keys", "old_verify_keys", "method", "uri", "origin", "destination", "room_id", "hashes"}
+
+// SigningRefusedError is returned when a caller asks for something to be signed which this
+// server won't sign.
+type SigningRefusedError struct {
+	Reason string
+}
+
+func (e *SigningRefusedError) Error() string {
+	return "refusing to sign: " + e.Reason
+}
+
+// SignEventAsSelf adds this server's content hash and signature to an event sent by one of its
+// own users, returning the whole event.
+func SignEventAsSelf(event map[string]interface{}, roomVersionId string) (map[string]interface{}, models.KeyID, error) {
+	roomVersion, err := signing.GetRoomVersion(roomVersionId)
+	if err != nil {
+		return nil, "", &SigningRefusedError{err.Error()}
+	}
+
+	sender, _ := event["sender"].(string)
+	senderServer, err := serverNameOf(sender)
+	if err != nil || senderServer != SelfDomainName {
+		return nil, "", &SigningRefusedError{fmt.Sprintf("sender %q is not a user of %s", sender, SelfDomainName)}
+	}
+	if origin, ok := event["origin"]; ok && origin != SelfDomainName {
+		return nil, "", &SigningRefusedError{fmt.Sprintf("origin %v is not %s", origin, SelfDomainName)}
+	}
+	if c, ok := event["content"]; ok {
+		if _, ok = c.(map[string]interface{}); !ok {
+			return nil, "", &SigningRefusedError{"content is not an object"}
+		}
+	}
+	if err = checkSignableShape(event); err != nil {
+		return nil, "", err
+	}
+
+	key, err := GetSelfKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed, err := signing.SignEventWithRedaction(event, roomVersion.Redaction, SelfDomainName, key.ID, key.Priv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// What was signed is the redacted event, but callers need the whole thing
+	full, err := util.InterfaceToMap(event)
+	if err != nil {
+		return nil, "", err
+	}
+	full["hashes"] = signed["hashes"]
+	full["signatures"] = signed["signatures"]
+	return full, key.ID, nil
+}
+
+// SignObjectAsSelf signs arbitrary JSON as this server, if SignObjectsAllowed. Objects which
+// look like they could be used to impersonate the server are refused.
+func SignObjectAsSelf(obj map[string]interface{}) (map[string]interface{}, models.KeyID, error) {
+	if !SignObjectsAllowed {
+		return nil, "", &SigningRefusedError{"signing arbitrary objects is disabled"}
+	}
+	for _, k := range refusedObjectKeys {
+		if _, ok := obj[k]; ok {
+			return nil, "", &SigningRefusedError{fmt.Sprintf("objects with %q are not signed", k)}
+		}
+	}
+	if err := checkSignableShape(obj); err != nil {
+		return nil, "", err
+	}
+
+	key, err := GetSelfKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	m, err := util.InterfaceToMap(obj)
+	if err != nil {
+		return nil, "", err
+	}
+	signed, err := signing.SignObject(m, SelfDomainName, key.ID, key.Priv)
+	if err != nil {
+		return nil, "", err
+	}
+	return signed, key.ID, nil
+}
+
+// HashSignableObject identifies an object in audit records without storing it.
+func HashSignableObject(obj map[string]interface{}) (models.UnpaddedBase64EncodedData, error) {
+	canonical, err := signing.EncodeCanonicalJson(obj)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(canonical)
+	return models.UnpaddedBase64EncodedData(signing.EncodeUnpaddedBase64ToString(h[:])), nil
+}
+
+// checkSignableShape makes sure the parts of an object touched while signing are the expected
+// types, rather than finding out part way through.
+func checkSignableShape(obj map[string]interface{}) error {
+	if u, ok := obj["unsigned"]; ok {
+		if _, ok = u.(map[string]interface{}); !ok {
+			return &SigningRefusedError{"unsigned is not an object"}
+		}
+	}
+	if s, ok := obj["signatures"]; ok {
+		sigs, ok := s.(map[string]interface{})
+		if !ok {
+			return &SigningRefusedError{"signatures is not an object"}
+		}
+		if d, ok := sigs[SelfDomainName]; ok {
+			if _, ok = d.(map[string]interface{}); !ok {
+				return &SigningRefusedError{"signatures for " + SelfDomainName + " are not an object"}
+			}
+		}
+	}
+	return nil
+}
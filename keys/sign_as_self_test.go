@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/t2bot/matrix-key-server/signing"
+	"golang.org/x/crypto/ed25519"
+)
+
+func useTestSelfKey(t *testing.T) *SelfKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &SelfKey{ID: "ed25519:test", Pub: pub, Priv: priv}
+
+	oldKey, oldDomain := ownKey, SelfDomainName
+	ownKey, SelfDomainName = key, "self.example.org"
+	t.Cleanup(func() {
+		ownKey, SelfDomainName = oldKey, oldDomain
+		SignObjectsAllowed = false
+	})
+	return key
+}
+
+func TestSignEventAsSelf(t *testing.T) {
+	key := useTestSelfKey(t)
+
+	event := map[string]interface{}{
+		"room_id":          "!r:self.example.org",
+		"sender":           "@bot:self.example.org",
+		"origin_server_ts": 1000000,
+		"type":             "m.room.message",
+		"content":          map[string]interface{}{"body": "hello"},
+		"unsigned":         map[string]interface{}{"age": 1},
+	}
+	signed, keyId, err := SignEventAsSelf(event, "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyId != key.ID {
+		t.Errorf("Expected key %s, got %s", key.ID, keyId)
+	}
+	if content, _ := signed["content"].(map[string]interface{}); content["body"] != "hello" {
+		t.Error("Expected the whole event back, not the redacted form")
+	}
+
+	hash, err := signing.CalculateSha256ContentHash(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := signed["hashes"].(map[string]interface{}); hashes["sha256"] != hash {
+		t.Errorf("Expected content hash %s, got %v", hash, signed["hashes"])
+	}
+
+	redacted, _, err := signing.RedactObject(signed, signing.RedactionV9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signing.VerifySignatures(redacted, map[string]map[string]ed25519.PublicKey{
+		"self.example.org": {string(key.ID): key.Pub},
+	})
+	if err != nil {
+		t.Errorf("Expected the signature to verify: %v", err)
+	}
+}
+
+func TestSignAsSelf_Refusals(t *testing.T) {
+	useTestSelfKey(t)
+
+	events := []struct {
+		name        string
+		roomVersion string
+		event       map[string]interface{}
+	}{
+		{"unknown room version", "999", map[string]interface{}{"sender": "@a:self.example.org"}},
+		{"sender of another server", "10", map[string]interface{}{"sender": "@a:other.example.org"}},
+		{"origin of another server", "10", map[string]interface{}{"sender": "@a:self.example.org", "origin": "other.example.org"}},
+		{"content isn't an object", "10", map[string]interface{}{"sender": "@a:self.example.org", "content": "hello"}},
+		{"signatures aren't an object", "10", map[string]interface{}{"sender": "@a:self.example.org", "signatures": []interface{}{}}},
+	}
+	for _, c := range events {
+		_, _, err := SignEventAsSelf(c.event, c.roomVersion)
+		refusedErr := &SigningRefusedError{}
+		if !errors.As(err, &refusedErr) {
+			t.Errorf("%s: expected a refusal, got %v", c.name, err)
+		}
+	}
+
+	obj := map[string]interface{}{"mxid": "@a:self.example.org", "token": "abc"}
+	if _, _, err := SignObjectAsSelf(obj); err == nil {
+		t.Error("Expected objects to be refused by default")
+	}
+
+	SignObjectsAllowed = true
+	if _, _, err := SignObjectAsSelf(obj); err != nil {
+		t.Errorf("Expected the object to be signed: %v", err)
+	}
+	for _, k := range refusedObjectKeys {
+		_, _, err := SignObjectAsSelf(map[string]interface{}{k: "x"})
+		refusedErr := &SigningRefusedError{}
+		if !errors.As(err, &refusedErr) {
+			t.Errorf("Expected an object with %s to be refused, got %v", k, err)
+		}
+	}
+}
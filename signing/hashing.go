@@ -18,6 +18,8 @@ package signing
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 
 	"github.com/t2bot/matrix-key-server/util"
 )
@@ -44,3 +46,47 @@ func CalculateSha256ContentHash(ev interface{}) (string, error) {
 	}
 	return EncodeUnpaddedBase64ToString(hbytes), nil
 }
+
+// CalculateReferenceHash calculates the SHA-256 of an event's redacted canonical form, without
+// its signatures. This is the event's reference hash, which is its event ID from room version 3.
+// From then on an event_id on the event can't have been part of the hash, so it is left out.
+func CalculateReferenceHash(ev interface{}, roomVersion *RoomVersion) ([]byte, error) {
+	redacted, _, err := RedactObject(ev, roomVersion.Redaction)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(redacted, "unsigned")
+	delete(redacted, "signatures")
+	if roomVersion.EventIdFormat != EventIdFormatV1 {
+		delete(redacted, "event_id")
+	}
+
+	b, err := EncodeCanonicalJson(redacted)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+// CalculateEventId works out an event's ID from its reference hash. Room versions 1 and 2 have
+// no such ID: their event IDs are chosen by the origin.
+func CalculateEventId(ev interface{}, roomVersion *RoomVersion) (string, error) {
+	var encoding *base64.Encoding
+	switch roomVersion.EventIdFormat {
+	case EventIdFormatV3:
+		encoding = base64.RawStdEncoding
+	case EventIdFormatV4:
+		encoding = base64.RawURLEncoding
+	default:
+		return "", errors.New("event IDs in room version " + roomVersion.Id + " are not reference hashes")
+	}
+
+	h, err := CalculateReferenceHash(ev, roomVersion)
+	if err != nil {
+		return "", err
+	}
+	return "$" + encoding.EncodeToString(h), nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signing
+
+import (
+	"testing"
+)
+
+func referenceHashEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"type":             "m.room.message",
+		"room_id":          "!r:a",
+		"sender":           "@a:a",
+		"origin_server_ts": 1000000,
+		"depth":            3,
+		"prev_events":      []interface{}{},
+		"auth_events":      []interface{}{},
+		"content":          map[string]interface{}{"body": "hi"},
+		"hashes":           map[string]interface{}{"sha256": "abc"},
+		"signatures":       map[string]interface{}{"a": map[string]interface{}{"ed25519:1": "sig"}},
+		"unsigned":         map[string]interface{}{"age": 1},
+	}
+}
+
+func TestCalculateEventId(t *testing.T) {
+	cases := []struct {
+		roomVersion string
+		expected    string
+	}{
+		{"3", "$IutWtZkOLICQKVqorlg6ZdyAHptXCLRUcb87+eFEdXQ"},
+		{"4", "$IutWtZkOLICQKVqorlg6ZdyAHptXCLRUcb87-eFEdXQ"},
+		{"10", "$IutWtZkOLICQKVqorlg6ZdyAHptXCLRUcb87-eFEdXQ"},
+	}
+	for _, c := range cases {
+		roomVersion, err := GetRoomVersion(c.roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventId, err := CalculateEventId(referenceHashEvent(), roomVersion)
+		if err != nil {
+			t.Errorf("v%s: unexpected error: %v", c.roomVersion, err)
+			continue
+		}
+		if eventId != c.expected {
+			t.Errorf("v%s: expected %s, got %s", c.roomVersion, c.expected, eventId)
+		}
+	}
+
+	// An event carrying its own ID still has the same ID
+	roomVersion, _ := GetRoomVersion("10")
+	ev := referenceHashEvent()
+	ev["event_id"] = "$IutWtZkOLICQKVqorlg6ZdyAHptXCLRUcb87-eFEdXQ"
+	if eventId, err := CalculateEventId(ev, roomVersion); err != nil || eventId != ev["event_id"] {
+		t.Errorf("Expected event_id to be left out of the event ID, got %s %v", eventId, err)
+	}
+
+	roomVersion, _ = GetRoomVersion("1")
+	if _, err := CalculateEventId(referenceHashEvent(), roomVersion); err == nil {
+		t.Error("Expected room version 1 event IDs to not be calculated")
+	}
+}
+
+func TestCalculateReferenceHash_RedactedForm(t *testing.T) {
+	roomVersion, err := GetRoomVersion("9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := CalculateReferenceHash(referenceHashEvent(), roomVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anything redaction removes doesn't change the hash, and anything it keeps does
+	cases := []struct {
+		name    string
+		change  func(ev map[string]interface{})
+		changed bool
+	}{
+		{"signatures", func(ev map[string]interface{}) { ev["signatures"] = map[string]interface{}{} }, false},
+		{"unsigned", func(ev map[string]interface{}) { delete(ev, "unsigned") }, false},
+		{"redacted content", func(ev map[string]interface{}) { ev["content"] = map[string]interface{}{"body": "bye"} }, false},
+		{"unknown top level key", func(ev map[string]interface{}) { ev["extra"] = true }, false},
+		{"content hash", func(ev map[string]interface{}) { ev["hashes"] = map[string]interface{}{"sha256": "def"} }, true},
+		{"depth", func(ev map[string]interface{}) { ev["depth"] = 4 }, true},
+		{"event_id", func(ev map[string]interface{}) { ev["event_id"] = "$IutWtZkOLICQKVqorlg6ZdyAHptXCLRUcb87-eFEdXQ" }, false},
+	}
+	for _, c := range cases {
+		ev := referenceHashEvent()
+		c.change(ev)
+		h, err := CalculateReferenceHash(ev, roomVersion)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if changed := string(h) != string(original); changed != c.changed {
+			t.Errorf("%s: expected changed=%t, got %t", c.name, c.changed, changed)
+		}
+	}
+}
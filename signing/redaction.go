@@ -18,47 +18,32 @@ package signing
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/t2bot/matrix-key-server/util"
 )
 
 type RedactionAlgorithm string
 
-const RedactionV1 = RedactionAlgorithm("v1")
+// Redaction algorithms are named after the room version which introduced them.
+const (
+	RedactionV1  = RedactionAlgorithm("v1")
+	RedactionV6  = RedactionAlgorithm("v6")
+	RedactionV8  = RedactionAlgorithm("v8")
+	RedactionV9  = RedactionAlgorithm("v9")
+	RedactionV11 = RedactionAlgorithm("v11")
+)
 
-func RedactObject(obj interface{}, algorithm RedactionAlgorithm) (map[string]interface{}, map[string]interface{}, error) {
-	if algorithm == RedactionV1 {
-		return redactObjectV1(obj)
-	} else {
-		return nil, nil, errors.New("unknown redaction algorithm")
-	}
+type redactionRules struct {
+	keepKeys              map[string]bool
+	keepContentKeysIfType map[string][]string
+	keepAllContentIfType  map[string]bool
 }
 
-func redactObjectV1(obj interface{}) (map[string]interface{}, map[string]interface{}, error) {
-	keepKeys := map[string]bool{
-		"event_id":         true,
-		"type":             true,
-		"room_id":          true,
-		"sender":           true,
-		"state_key":        true,
-		"content":          true,
-		"hashes":           true,
-		"signatures":       true,
-		"depth":            true,
-		"prev_events":      true,
-		"prev_state":       true,
-		"auth_events":      true,
-		"origin":           true,
-		"origin_server_ts": true,
-		"membership":       true,
-	}
-	keepContentKeysIfType := map[string][]string{
-		"m.room.member":             {"membership"},
-		"m.room.create":             {"creator"},
-		"m.room.join_rules":         {"join_rule"},
-		"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
-		"m.room.aliases":            {"aliases"},
-		"m.room.history_visibility": {"history_visibility"},
+func RedactObject(obj interface{}, algorithm RedactionAlgorithm) (map[string]interface{}, map[string]interface{}, error) {
+	rules, err := getRedactionRules(algorithm)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	m, err := util.InterfaceToMap(obj)
@@ -70,39 +55,121 @@ func redactObjectV1(obj interface{}) (map[string]interface{}, map[string]interfa
 	if u, ok := m["unsigned"]; !ok {
 		unsigned = nil
 	} else {
-		unsigned = u.(map[string]interface{})
+		unsigned, _ = u.(map[string]interface{})
 	}
 
-	p, err := pruneObject(m, keepKeys, keepContentKeysIfType)
+	p, err := pruneObject(m, rules)
 	return p, unsigned, err
 }
 
-func pruneObject(obj map[string]interface{}, keepKeys map[string]bool, keepContentKeysIfType map[string][]string) (map[string]interface{}, error) {
+// getRedactionRules builds the rules for an algorithm. Each algorithm is a set of changes to
+// the one before it, so the rules are built up in order.
+func getRedactionRules(algorithm RedactionAlgorithm) (*redactionRules, error) {
+	rules := &redactionRules{
+		keepKeys: map[string]bool{
+			"event_id":         true,
+			"type":             true,
+			"room_id":          true,
+			"sender":           true,
+			"state_key":        true,
+			"content":          true,
+			"hashes":           true,
+			"signatures":       true,
+			"depth":            true,
+			"prev_events":      true,
+			"prev_state":       true,
+			"auth_events":      true,
+			"origin":           true,
+			"origin_server_ts": true,
+			"membership":       true,
+		},
+		keepContentKeysIfType: map[string][]string{
+			"m.room.member":             {"membership"},
+			"m.room.create":             {"creator"},
+			"m.room.join_rules":         {"join_rule"},
+			"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+			"m.room.aliases":            {"aliases"},
+			"m.room.history_visibility": {"history_visibility"},
+		},
+		keepAllContentIfType: map[string]bool{},
+	}
+
+	switch algorithm {
+	case RedactionV1:
+		return rules, nil
+	case RedactionV6, RedactionV8, RedactionV9, RedactionV11:
+	default:
+		return nil, errors.New("unknown redaction algorithm")
+	}
+
+	// Room version 6 stopped treating m.room.aliases specially
+	delete(rules.keepContentKeysIfType, "m.room.aliases")
+	if algorithm == RedactionV6 {
+		return rules, nil
+	}
+
+	// Room version 8 added restricted join rules
+	rules.keepContentKeysIfType["m.room.join_rules"] = []string{"join_rule", "allow"}
+	if algorithm == RedactionV8 {
+		return rules, nil
+	}
+
+	// Room version 9 kept the server which authorised a restricted join
+	rules.keepContentKeysIfType["m.room.member"] = []string{"membership", "join_authorised_via_users_server"}
+	if algorithm == RedactionV9 {
+		return rules, nil
+	}
+
+	// Room version 11 reworked the top level keys and kept more content
+	delete(rules.keepKeys, "origin")
+	delete(rules.keepKeys, "membership")
+	delete(rules.keepKeys, "prev_state")
+	delete(rules.keepContentKeysIfType, "m.room.create")
+	rules.keepAllContentIfType["m.room.create"] = true
+	rules.keepContentKeysIfType["m.room.member"] = []string{"membership", "join_authorised_via_users_server", "third_party_invite.signed"}
+	rules.keepContentKeysIfType["m.room.power_levels"] = append(rules.keepContentKeysIfType["m.room.power_levels"], "invite")
+	rules.keepContentKeysIfType["m.room.redaction"] = []string{"redacts"}
+	return rules, nil
+}
+
+func pruneObject(obj map[string]interface{}, rules *redactionRules) (map[string]interface{}, error) {
 	var m = make(map[string]interface{})
 
 	for k, v := range obj {
-		if val, ok := keepKeys[k]; ok && val {
+		if val, ok := rules.keepKeys[k]; ok && val {
 			m[k] = v
 		}
 	}
 
-	if t, ok := m["type"]; ok {
-		eventType := t.(string)
-		if c, ok := m["content"]; ok {
-			eventContent := c.(map[string]interface{})
-			newContent := make(map[string]interface{})
-			if keysToKeep, ok := keepContentKeysIfType[eventType]; ok {
-				for _, k := range keysToKeep {
-					if v, ok := eventContent[k]; ok {
-						newContent[k] = v
-					}
+	if _, ok := m["content"]; !ok {
+		return m, nil
+	}
+
+	eventType, _ := m["type"].(string)
+	eventContent, ok := m["content"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("content is not an object")
+	}
+	if rules.keepAllContentIfType[eventType] {
+		return m, nil
+	}
+
+	newContent := make(map[string]interface{})
+	for _, k := range rules.keepContentKeysIfType[eventType] {
+		// Dotted keys keep a single key of a nested object
+		if parent, child, nested := strings.Cut(k, "."); nested {
+			if p, ok := eventContent[parent].(map[string]interface{}); ok {
+				if v, ok := p[child]; ok {
+					newContent[parent] = map[string]interface{}{child: v}
 				}
 			}
-			m["content"] = newContent
+			continue
+		}
+		if v, ok := eventContent[k]; ok {
+			newContent[k] = v
 		}
-	} else if _, ok := m["content"]; ok {
-		m["content"] = make(map[string]interface{})
 	}
+	m["content"] = newContent
 
 	return m, nil
 }
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactObject_RoomVersions(t *testing.T) {
+	cases := []struct {
+		name      string
+		algorithm RedactionAlgorithm
+		event     map[string]interface{}
+		expected  map[string]interface{}
+	}{
+		{
+			name:      "v1 keeps aliases",
+			algorithm: RedactionV1,
+			event:     map[string]interface{}{"type": "m.room.aliases", "content": map[string]interface{}{"aliases": []interface{}{"#a:b"}, "x": 1}},
+			expected:  map[string]interface{}{"type": "m.room.aliases", "content": map[string]interface{}{"aliases": []interface{}{"#a:b"}}},
+		},
+		{
+			name:      "v6 drops aliases",
+			algorithm: RedactionV6,
+			event:     map[string]interface{}{"type": "m.room.aliases", "content": map[string]interface{}{"aliases": []interface{}{"#a:b"}}},
+			expected:  map[string]interface{}{"type": "m.room.aliases", "content": map[string]interface{}{}},
+		},
+		{
+			name:      "v6 drops join rule allow",
+			algorithm: RedactionV6,
+			event:     map[string]interface{}{"type": "m.room.join_rules", "content": map[string]interface{}{"join_rule": "restricted", "allow": []interface{}{}}},
+			expected:  map[string]interface{}{"type": "m.room.join_rules", "content": map[string]interface{}{"join_rule": "restricted"}},
+		},
+		{
+			name:      "v8 keeps join rule allow",
+			algorithm: RedactionV8,
+			event:     map[string]interface{}{"type": "m.room.join_rules", "content": map[string]interface{}{"join_rule": "restricted", "allow": []interface{}{}}},
+			expected:  map[string]interface{}{"type": "m.room.join_rules", "content": map[string]interface{}{"join_rule": "restricted", "allow": []interface{}{}}},
+		},
+		{
+			name:      "v9 keeps the authorising user",
+			algorithm: RedactionV9,
+			event:     map[string]interface{}{"type": "m.room.member", "content": map[string]interface{}{"membership": "join", "join_authorised_via_users_server": "@a:b", "displayname": "A"}},
+			expected:  map[string]interface{}{"type": "m.room.member", "content": map[string]interface{}{"membership": "join", "join_authorised_via_users_server": "@a:b"}},
+		},
+		{
+			name:      "v9 keeps top level origin",
+			algorithm: RedactionV9,
+			event:     map[string]interface{}{"type": "m.room.message", "origin": "b", "membership": "join", "prev_state": []interface{}{}},
+			expected:  map[string]interface{}{"type": "m.room.message", "origin": "b", "membership": "join", "prev_state": []interface{}{}},
+		},
+		{
+			name:      "v11 drops top level origin",
+			algorithm: RedactionV11,
+			event:     map[string]interface{}{"type": "m.room.message", "origin": "b", "membership": "join", "prev_state": []interface{}{}},
+			expected:  map[string]interface{}{"type": "m.room.message"},
+		},
+		{
+			name:      "v11 keeps all create content",
+			algorithm: RedactionV11,
+			event:     map[string]interface{}{"type": "m.room.create", "content": map[string]interface{}{"room_version": "11", "m.federate": false}},
+			expected:  map[string]interface{}{"type": "m.room.create", "content": map[string]interface{}{"room_version": "11", "m.federate": false}},
+		},
+		{
+			name:      "v11 keeps redacts",
+			algorithm: RedactionV11,
+			event:     map[string]interface{}{"type": "m.room.redaction", "content": map[string]interface{}{"redacts": "$a", "reason": "spam"}},
+			expected:  map[string]interface{}{"type": "m.room.redaction", "content": map[string]interface{}{"redacts": "$a"}},
+		},
+		{
+			name:      "v11 keeps the signed third party invite",
+			algorithm: RedactionV11,
+			event: map[string]interface{}{"type": "m.room.member", "content": map[string]interface{}{
+				"membership":         "invite",
+				"third_party_invite": map[string]interface{}{"display_name": "A", "signed": map[string]interface{}{"token": "t"}},
+			}},
+			expected: map[string]interface{}{"type": "m.room.member", "content": map[string]interface{}{
+				"membership":         "invite",
+				"third_party_invite": map[string]interface{}{"signed": map[string]interface{}{"token": "t"}},
+			}},
+		},
+	}
+
+	for _, c := range cases {
+		redacted, _, err := RedactObject(c.event, c.algorithm)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(redacted, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, redacted)
+		}
+	}
+
+	if _, _, err := RedactObject(map[string]interface{}{}, RedactionAlgorithm("v0")); err == nil {
+		t.Error("Expected an unknown algorithm to be an error")
+	}
+}
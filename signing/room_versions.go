@@ -0,0 +1,62 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signing
+
+import (
+	"fmt"
+)
+
+type EventIdFormat string
+
+const (
+	// EventIdFormatV1 event IDs are chosen by the origin, which must sign the event
+	EventIdFormatV1 = EventIdFormat("v1")
+	// EventIdFormatV3 event IDs are the event's reference hash in standard base64
+	EventIdFormatV3 = EventIdFormat("v3")
+	// EventIdFormatV4 event IDs are the event's reference hash in URL-safe base64
+	EventIdFormatV4 = EventIdFormat("v4")
+)
+
+// RoomVersion describes how events in a room version are redacted, identified, and signed.
+type RoomVersion struct {
+	Id                 string
+	Redaction          RedactionAlgorithm
+	EventIdFormat      EventIdFormat
+	EnforceKeyValidity bool
+	RestrictedJoins    bool
+}
+
+var roomVersions = map[string]*RoomVersion{
+	"1":  {"1", RedactionV1, EventIdFormatV1, false, false},
+	"2":  {"2", RedactionV1, EventIdFormatV1, false, false},
+	"3":  {"3", RedactionV1, EventIdFormatV3, false, false},
+	"4":  {"4", RedactionV1, EventIdFormatV4, false, false},
+	"5":  {"5", RedactionV1, EventIdFormatV4, true, false},
+	"6":  {"6", RedactionV6, EventIdFormatV4, true, false},
+	"7":  {"7", RedactionV6, EventIdFormatV4, true, false},
+	"8":  {"8", RedactionV8, EventIdFormatV4, true, true},
+	"9":  {"9", RedactionV9, EventIdFormatV4, true, true},
+	"10": {"10", RedactionV9, EventIdFormatV4, true, true},
+	"11": {"11", RedactionV11, EventIdFormatV4, true, true},
+}
+
+func GetRoomVersion(id string) (*RoomVersion, error) {
+	if v, ok := roomVersions[id]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported room version %q", id)
+}
@@ -23,7 +23,12 @@ import (
 )
 
 func SignEvent(obj interface{}, domain string, keyId models.KeyID, key ed25519.PrivateKey) (map[string]interface{}, error) {
-	redacted, unsigned, err := RedactObject(obj, RedactionV1)
+	return SignEventWithRedaction(obj, RedactionV1, domain, keyId, key)
+}
+
+// SignEventWithRedaction is SignEvent for events in rooms which redact with a different algorithm.
+func SignEventWithRedaction(obj interface{}, algorithm RedactionAlgorithm, domain string, keyId models.KeyID, key ed25519.PrivateKey) (map[string]interface{}, error) {
+	redacted, unsigned, err := RedactObject(obj, algorithm)
 	if err != nil {
 		return nil, err
 	}
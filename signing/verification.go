@@ -31,12 +31,8 @@ func VerifySignatures(obj interface{}, publicKeys map[string]map[string]ed25519.
 
 	delete(m, "unsigned")
 
-	var signatures map[string]interface{}
-	if s, ok := m["signatures"]; !ok {
-		signatures = nil
-	} else {
-		signatures = s.(map[string]interface{})
-	}
+	// The object usually came from someone else, so its shape can't be trusted
+	signatures, _ := m["signatures"].(map[string]interface{})
 	delete(m, "signatures")
 
 	if len(signatures) == 0 {
@@ -56,14 +52,21 @@ func VerifySignatures(obj interface{}, publicKeys map[string]map[string]ed25519.
 			return errors.New("missing public keys for " + domain)
 		}
 
-		keySigs := sig.(map[string]interface{})
+		keySigs, ok := sig.(map[string]interface{})
+		if !ok {
+			return errors.New("invalid signatures for " + domain)
+		}
 		for keyId, b64 := range keySigs {
 			var publicKey ed25519.PublicKey
 			if publicKey, ok = domainKeys[keyId]; !ok {
 				return errors.New(fmt.Sprintf("missing public key for %s %s", domain, keyId))
 			}
 
-			signature, err := DecodeUnpaddedBase64String(b64.(string))
+			encoded, ok := b64.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("invalid signature for %s %s", domain, keyId))
+			}
+			signature, err := DecodeUnpaddedBase64String(encoded)
 			if err != nil {
 				return err
 			}
@@ -56,3 +56,19 @@ func TestVerifyObject_WithContent(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestVerifyObject_MalformedSignatures(t *testing.T) {
+	objects := []map[string]interface{}{
+		{"one": 1},
+		{"one": 1, "signatures": nil},
+		{"one": 1, "signatures": "nope"},
+		{"one": 1, "signatures": map[string]interface{}{domain: "nope"}},
+		{"one": 1, "signatures": map[string]interface{}{domain: map[string]interface{}{string(keyId): 1}}},
+	}
+	for i, obj := range objects {
+		err := VerifySignatures(obj, publicKeys)
+		if err == nil {
+			t.Errorf("%d: expected malformed signatures to fail verification", i)
+		}
+	}
+}
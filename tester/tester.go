@@ -0,0 +1,365 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tester
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/keys"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// maxVersionResponseSize is the largest /_matrix/federation/v1/version response we'll read.
+const maxVersionResponseSize = int64(64 * 1024)
+
+// ReportTtl is how long a server's report is reused for, so repeated tests of the same server
+// don't contact it again. 0 disables this.
+var ReportTtl = 1 * time.Minute
+
+var reportCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// fetchSlots caps the requests the tester has in flight across all tests.
+var fetchSlots = make(chan struct{}, 16)
+
+// SetMaxConcurrentFetches changes how many requests the tester may have in flight at once.
+func SetMaxConcurrentFetches(n int) {
+	if n < 1 {
+		n = 1
+	}
+	fetchSlots = make(chan struct{}, n)
+}
+
+// Report is the outcome of testing a server's federation setup, in the spirit of the
+// federation tester: how it was discovered, and what each of its addresses said.
+type Report struct {
+	ServerName   string                     `json:"server_name"`
+	Resolution   *federation.ResolvedServer `json:"resolution"`
+	Connections  []*ConnectionReport        `json:"connections"`
+	FederationOk bool                       `json:"federation_ok"`
+	Error        string                     `json:"error,omitempty"`
+	Cached       bool                       `json:"cached"`
+}
+
+type ConnectionReport struct {
+	Target  string         `json:"target"`
+	Address string         `json:"address"`
+	Tls     *TlsReport     `json:"tls"`
+	Version *VersionReport `json:"version"`
+	Keys    *KeysReport    `json:"keys"`
+	Ok      bool           `json:"ok"`
+
+	// Set when the target's addresses couldn't be looked up
+	Error string               `json:"error,omitempty"`
+	Kind  federation.ErrorKind `json:"kind,omitempty"`
+}
+
+type TlsReport struct {
+	Version      string               `json:"version,omitempty"`
+	CipherSuite  string               `json:"cipher_suite,omitempty"`
+	Protocol     string               `json:"protocol,omitempty"`
+	Certificates []*CertificateReport `json:"certificates"`
+
+	// Set when the handshake failed because the certificates couldn't be verified
+	Error string `json:"error,omitempty"`
+}
+
+type CertificateReport struct {
+	Subject   string   `json:"subject"`
+	Issuer    string   `json:"issuer"`
+	DnsNames  []string `json:"dns_names"`
+	NotBefore int64    `json:"not_before_ts"`
+	NotAfter  int64    `json:"not_after_ts"`
+	Sha256    string   `json:"sha256_fingerprint"`
+}
+
+type VersionReport struct {
+	Name    string               `json:"name,omitempty"`
+	Version string               `json:"version,omitempty"`
+	Error   string               `json:"error,omitempty"`
+	Kind    federation.ErrorKind `json:"kind,omitempty"`
+}
+
+type KeysReport struct {
+	ServerName   string               `json:"server_name,omitempty"`
+	ValidUntilTs int64                `json:"valid_until_ts,omitempty"`
+	VerifyKeys   map[string]string    `json:"verify_keys,omitempty"`
+	Checks       *KeyChecks           `json:"checks,omitempty"`
+	Error        string               `json:"error,omitempty"`
+	Kind         federation.ErrorKind `json:"kind,omitempty"`
+}
+
+type KeyChecks struct {
+	MatchingServerName bool                      `json:"matching_server_name"`
+	FutureValidUntilTs bool                      `json:"future_valid_until_ts"`
+	HasEd25519Key      bool                      `json:"has_ed25519_key"`
+	AllEd25519ChecksOk bool                      `json:"all_ed25519_checks_ok"`
+	Ed25519Checks      map[string]*Ed25519Checks `json:"ed25519_checks"`
+	AllChecksOk        bool                      `json:"all_checks_ok"`
+}
+
+type Ed25519Checks struct {
+	ValidEd25519      bool `json:"valid_ed25519"`
+	MatchingSignature bool `json:"matching_signature"`
+}
+
+type serverKeys struct {
+	ServerName   string `json:"server_name"`
+	ValidUntilTs int64  `json:"valid_until_ts"`
+	VerifyKeys   map[string]struct {
+		Key string `json:"key"`
+	} `json:"verify_keys"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// Test runs server discovery for a server name, then asks every address it finds for its
+// version and keys. Discovery isn't cached, and keys fetched here are not stored, but the
+// report is reused for ReportTtl.
+func Test(serverName string) *Report {
+	if record, found := reportCache.Get(serverName); found {
+		// The cached report is shared, so only hand out copies of it
+		report := *record.(*Report)
+		report.Cached = true
+		return &report
+	}
+
+	report := runTest(serverName)
+	if ReportTtl > 0 {
+		reportCache.Set(serverName, report, ReportTtl)
+	}
+
+	r := *report
+	return &r
+}
+
+func runTest(serverName string) *Report {
+	report := &Report{
+		ServerName:  serverName,
+		Connections: make([]*ConnectionReport, 0),
+	}
+
+	res, err := federation.ResolveServerUncached(serverName)
+	report.Resolution = res
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	type pending struct {
+		target federation.Target
+		conn   *ConnectionReport
+	}
+	toTest := make([]pending, 0)
+	for _, target := range res.Targets {
+		targetName := net.JoinHostPort(target.Host, target.Port)
+		addrs, err := target.Addresses()
+		if err != nil {
+			report.Connections = append(report.Connections, &ConnectionReport{
+				Target: targetName,
+				Error:  err.Error(),
+				Kind:   federation.Classify(err),
+			})
+			continue
+		}
+		for _, addr := range addrs {
+			c := &ConnectionReport{Target: targetName, Address: addr}
+			report.Connections = append(report.Connections, c)
+			toTest = append(toTest, pending{target, c})
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, p := range toTest {
+		wg.Add(1)
+		go func(p pending) {
+			defer wg.Done()
+			testConnection(res, p.target, p.conn)
+		}(p)
+	}
+	wg.Wait()
+
+	report.FederationOk = len(report.Connections) > 0
+	for _, c := range report.Connections {
+		report.FederationOk = report.FederationOk && c.Ok
+	}
+	return report
+}
+
+// addressRequest makes a request for a test once there is room for it.
+func addressRequest(res *federation.ResolvedServer, target federation.Target, addr string, path string) (*http.Response, error) {
+	slots := fetchSlots
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return federation.AddressRequest(res, target, addr, "GET", path, nil, nil)
+}
+
+func testConnection(res *federation.ResolvedServer, target federation.Target, c *ConnectionReport) {
+	c.Version = &VersionReport{}
+	resp, err := addressRequest(res, target, c.Address, "/_matrix/federation/v1/version")
+	if err == nil {
+		if resp.TLS != nil {
+			c.Tls = tlsReport(resp.TLS)
+		}
+		version := &struct {
+			Server struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"server"`
+		}{}
+		err = federation.DecodeJsonResponse(resp, maxVersionResponseSize, version)
+		c.Version.Name = version.Server.Name
+		c.Version.Version = version.Server.Version
+	}
+	if err != nil {
+		c.Version.Error = err.Error()
+		c.Version.Kind = federation.Classify(err)
+		if c.Tls == nil {
+			c.Tls = tlsFailureReport(err)
+		}
+	}
+
+	c.Keys = &KeysReport{}
+	resp, err = addressRequest(res, target, c.Address, "/_matrix/key/v2/server")
+	if err == nil {
+		if c.Tls == nil && resp.TLS != nil {
+			c.Tls = tlsReport(resp.TLS)
+		}
+		var raw json.RawMessage
+		err = federation.DecodeJsonResponse(resp, keys.MaxKeyResponseSize, &raw)
+		if err == nil {
+			c.Keys, err = checkKeys(res.ServerName, raw)
+		}
+	}
+	if err != nil {
+		c.Keys.Error = err.Error()
+		c.Keys.Kind = federation.Classify(err)
+		if c.Tls == nil {
+			c.Tls = tlsFailureReport(err)
+		}
+	}
+
+	c.Ok = c.Version.Error == "" && c.Keys.Checks != nil && c.Keys.Checks.AllChecksOk
+}
+
+// checkKeys verifies a /_matrix/key/v2/server response the same way the federation tester does.
+func checkKeys(serverName string, raw []byte) (*KeysReport, error) {
+	report := &KeysReport{}
+
+	parsed := &serverKeys{}
+	err := json.Unmarshal(raw, parsed)
+	if err != nil {
+		return report, &federation.InvalidResponseError{Err: err}
+	}
+	report.ServerName = parsed.ServerName
+	report.ValidUntilTs = parsed.ValidUntilTs
+	report.VerifyKeys = make(map[string]string)
+
+	obj := make(map[string]interface{})
+	err = json.Unmarshal(raw, &obj)
+	if err != nil {
+		return report, &federation.InvalidResponseError{Err: err}
+	}
+	delete(obj, "signatures")
+	delete(obj, "unsigned")
+	canonical, err := signing.EncodeCanonicalJson(obj)
+	if err != nil {
+		return report, &federation.InvalidResponseError{Err: err}
+	}
+
+	checks := &KeyChecks{
+		MatchingServerName: parsed.ServerName == serverName,
+		FutureValidUntilTs: parsed.ValidUntilTs > util.NowMillis(),
+		AllEd25519ChecksOk: true,
+		Ed25519Checks:      make(map[string]*Ed25519Checks),
+	}
+	for keyId, key := range parsed.VerifyKeys {
+		report.VerifyKeys[keyId] = key.Key
+		if !strings.HasPrefix(keyId, "ed25519:") {
+			continue
+		}
+		checks.HasEd25519Key = true
+
+		c := &Ed25519Checks{}
+		pub, err := signing.DecodeUnpaddedBase64String(key.Key)
+		c.ValidEd25519 = err == nil && len(pub) == ed25519.PublicKeySize
+		if c.ValidEd25519 {
+			sig, err := signing.DecodeUnpaddedBase64String(parsed.Signatures[parsed.ServerName][keyId])
+			c.MatchingSignature = err == nil && ed25519.Verify(pub, canonical, sig)
+		}
+		checks.Ed25519Checks[keyId] = c
+		checks.AllEd25519ChecksOk = checks.AllEd25519ChecksOk && c.ValidEd25519 && c.MatchingSignature
+	}
+	checks.AllChecksOk = checks.MatchingServerName && checks.FutureValidUntilTs && checks.HasEd25519Key && checks.AllEd25519ChecksOk
+
+	report.Checks = checks
+	return report, nil
+}
+
+func tlsReport(state *tls.ConnectionState) *TlsReport {
+	report := &TlsReport{
+		Version:      tls.VersionName(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		Protocol:     state.NegotiatedProtocol,
+		Certificates: make([]*CertificateReport, 0, len(state.PeerCertificates)),
+	}
+	for _, cert := range state.PeerCertificates {
+		report.Certificates = append(report.Certificates, certificateReport(cert))
+	}
+	return report
+}
+
+// tlsFailureReport describes the certificates a server presented when they failed
+// verification, or returns nil if the request didn't fail for that reason.
+func tlsFailureReport(err error) *TlsReport {
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		return nil
+	}
+	report := &TlsReport{
+		Certificates: make([]*CertificateReport, 0, len(verifyErr.UnverifiedCertificates)),
+		Error:        verifyErr.Err.Error(),
+	}
+	for _, cert := range verifyErr.UnverifiedCertificates {
+		report.Certificates = append(report.Certificates, certificateReport(cert))
+	}
+	return report
+}
+
+func certificateReport(cert *x509.Certificate) *CertificateReport {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &CertificateReport{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		DnsNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore.UnixNano() / 1000000,
+		NotAfter:  cert.NotAfter.UnixNano() / 1000000,
+		Sha256:    hex.EncodeToString(fingerprint[:]),
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tester
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/t2bot/matrix-key-server/federation"
+	"github.com/t2bot/matrix-key-server/signing"
+	"github.com/t2bot/matrix-key-server/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testKey = ed25519.NewKeyFromSeed([]byte("00000000000000000000000000000000"))
+
+func signedKeys(t *testing.T, serverName string, validUntilTs int64, key ed25519.PrivateKey) []byte {
+	obj := map[string]interface{}{
+		"server_name":    serverName,
+		"valid_until_ts": validUntilTs,
+		"verify_keys": map[string]interface{}{
+			"ed25519:test": map[string]interface{}{
+				"key": signing.EncodeUnpaddedBase64ToString(testKey.Public().(ed25519.PublicKey)),
+			},
+		},
+		"old_verify_keys": map[string]interface{}{},
+	}
+	signed, err := signing.SignObject(obj, serverName, "ed25519:test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCheckKeys(t *testing.T) {
+	future := util.NowMillis() + 3600000
+	otherKey := ed25519.NewKeyFromSeed([]byte("11111111111111111111111111111111"))
+
+	cases := []struct {
+		name               string
+		raw                []byte
+		matchingServerName bool
+		futureValidUntilTs bool
+		matchingSignature  bool
+		allChecksOk        bool
+	}{
+		{"valid", signedKeys(t, "example.org", future, testKey), true, true, true, true},
+		{"wrong server name", signedKeys(t, "other.example.org", future, testKey), false, true, true, false},
+		{"expired", signedKeys(t, "example.org", util.NowMillis()-1000, testKey), true, false, true, false},
+		{"wrong signature", signedKeys(t, "example.org", future, otherKey), true, true, false, false},
+	}
+
+	for _, c := range cases {
+		report, err := checkKeys("example.org", c.raw)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		checks := report.Checks
+		if checks.MatchingServerName != c.matchingServerName {
+			t.Errorf("%s: expected matching_server_name=%v", c.name, c.matchingServerName)
+		}
+		if checks.FutureValidUntilTs != c.futureValidUntilTs {
+			t.Errorf("%s: expected future_valid_until_ts=%v", c.name, c.futureValidUntilTs)
+		}
+		if !checks.HasEd25519Key || !checks.Ed25519Checks["ed25519:test"].ValidEd25519 {
+			t.Errorf("%s: expected a valid ed25519 key", c.name)
+		}
+		if checks.Ed25519Checks["ed25519:test"].MatchingSignature != c.matchingSignature {
+			t.Errorf("%s: expected matching_signature=%v", c.name, c.matchingSignature)
+		}
+		if checks.AllChecksOk != c.allChecksOk {
+			t.Errorf("%s: expected all_checks_ok=%v", c.name, c.allChecksOk)
+		}
+	}
+
+	if _, err := checkKeys("example.org", []byte(`[]`)); err == nil {
+		t.Error("Expected an error for a response which isn't an object")
+	}
+}
+
+// countingClient fails every request, keeping track of how many there were and how many
+// were in flight at once.
+type countingClient struct {
+	requests    int
+	inFlight    int
+	maxInFlight int
+	lock        sync.Mutex
+}
+
+func (c *countingClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	c.requests++
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	return nil, errors.New("connection refused")
+}
+
+func useCountingClient(t *testing.T) *countingClient {
+	client := &countingClient{}
+	federation.SetFederationClientFactory(func(tlsServerName string) federation.HttpClient {
+		return client
+	})
+	reportCache.Flush()
+	t.Cleanup(func() {
+		federation.SetFederationClientFactory(nil)
+		reportCache.Flush()
+	})
+	return client
+}
+
+func TestTest_ReusesReports(t *testing.T) {
+	client := useCountingClient(t)
+
+	first := Test("192.0.2.1:8448")
+	if first.Cached {
+		t.Error("Expected the first report to be fresh")
+	}
+	second := Test("192.0.2.1:8448")
+	if !second.Cached {
+		t.Error("Expected the second report to be cached")
+	}
+	if first.Cached {
+		t.Error("Expected the first report to be unaffected by later hits")
+	}
+
+	// One version and one keys request for the server's only address
+	if client.requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", client.requests)
+	}
+}
+
+func TestTest_LimitsConcurrentFetches(t *testing.T) {
+	client := useCountingClient(t)
+	SetMaxConcurrentFetches(2)
+	t.Cleanup(func() {
+		SetMaxConcurrentFetches(16)
+	})
+
+	wg := &sync.WaitGroup{}
+	for _, serverName := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		wg.Add(1)
+		go func(serverName string) {
+			defer wg.Done()
+			Test(serverName)
+		}(serverName)
+	}
+	wg.Wait()
+
+	if client.requests != 8 {
+		t.Errorf("Expected 8 requests, got %d", client.requests)
+	}
+	if client.maxInFlight > 2 {
+		t.Errorf("Expected at most 2 requests at once, got %d", client.maxInFlight)
+	}
+}
+
+func TestTlsFailureReport(t *testing.T) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wrong.example.org"},
+		DNSNames:     []string{"wrong.example.org"},
+		NotBefore:    time.Unix(1560000000, 0),
+		NotAfter:     time.Unix(1567776000, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, testKey.Public(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeErr := &url.Error{Op: "Get", URL: "https://192.0.2.1:8448", Err: &tls.CertificateVerificationError{
+		UnverifiedCertificates: []*x509.Certificate{cert},
+		Err:                    cert.VerifyHostname("example.org"),
+	}}
+	report := tlsFailureReport(handshakeErr)
+	if report == nil {
+		t.Fatal("Expected a report for a certificate verification failure")
+	}
+	if len(report.Certificates) != 1 || report.Certificates[0].Subject != "CN=wrong.example.org" {
+		t.Errorf("Expected the presented certificate to be reported, got %+v", report.Certificates)
+	}
+	if report.Error == "" {
+		t.Error("Expected the verification error to be reported")
+	}
+
+	if tlsFailureReport(errors.New("connection refused")) != nil {
+		t.Error("Expected no report for a failure unrelated to certificates")
+	}
+}
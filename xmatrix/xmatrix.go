@@ -0,0 +1,261 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xmatrix parses and formats the X-Matrix Authorization headers used to authenticate
+// requests between Matrix homeservers.
+package xmatrix
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const Scheme = "X-Matrix"
+
+// ErrNotXMatrix is returned for Authorization headers which use a different scheme.
+var ErrNotXMatrix = errors.New("not an X-Matrix Authorization header")
+
+type ParseError struct {
+	Header string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid X-Matrix Authorization header: %s", e.Reason)
+}
+
+// Auth is one X-Matrix Authorization header. Destination is empty if the header didn't
+// include one, which older servers don't.
+type Auth struct {
+	Origin      string
+	Destination string
+	KeyID       string
+	Signature   string
+}
+
+// String formats the Auth as an Authorization header value.
+func (a *Auth) String() string {
+	s := Scheme + " origin=" + quote(a.Origin)
+	if a.Destination != "" {
+		s += ",destination=" + quote(a.Destination)
+	}
+	return s + ",key=" + quote(a.KeyID) + ",sig=" + quote(a.Signature)
+}
+
+// ParseAll parses the X-Matrix headers out of a request's Authorization header values,
+// ignoring any using another scheme. An error is returned if any X-Matrix header is
+// invalid, or if there are none.
+func ParseAll(headers []string) ([]*Auth, error) {
+	auths := make([]*Auth, 0, len(headers))
+	for _, h := range headers {
+		a, err := Parse(h)
+		if err == ErrNotXMatrix {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, a)
+	}
+	if len(auths) == 0 {
+		return nil, ErrNotXMatrix
+	}
+	return auths, nil
+}
+
+// Parse parses a single X-Matrix Authorization header value.
+func Parse(header string) (*Auth, error) {
+	params, err := parseCredentials(header)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Auth{
+		Origin:      params["origin"],
+		Destination: params["destination"],
+		KeyID:       params["key"],
+		Signature:   params["sig"],
+	}
+	for name, v := range map[string]string{"origin": a.Origin, "key": a.KeyID, "sig": a.Signature} {
+		if v == "" {
+			return nil, &ParseError{Header: header, Reason: "missing " + name}
+		}
+	}
+	if _, ok := params["destination"]; ok && a.Destination == "" {
+		return nil, &ParseError{Header: header, Reason: "empty destination"}
+	}
+	return a, nil
+}
+
+// parseCredentials parses an Authorization header following the credentials grammar of
+// RFC 9110 section 11.4, returning its auth-params with lowercased names:
+//
+//	credentials = auth-scheme [ 1*SP ( token68 / #auth-param ) ]
+//	auth-param  = token BWS "=" BWS ( token / quoted-string )
+//
+// Unquoted values are allowed to contain any visible characters other than commas and
+// quotes, as some servers send key IDs (with a colon) and base64 signatures (with slashes
+// and padding) without quoting them.
+func parseCredentials(header string) (map[string]string, error) {
+	p := &parser{s: header}
+
+	scheme := p.token()
+	if !strings.EqualFold(scheme, Scheme) {
+		return nil, ErrNotXMatrix
+	}
+	if p.done() {
+		return nil, &ParseError{Header: header, Reason: "no parameters"}
+	}
+	if !p.skipSpaces() {
+		return nil, &ParseError{Header: header, Reason: "expected a space after the scheme"}
+	}
+
+	params := make(map[string]string)
+	for {
+		// Empty list elements are allowed, eg: "a=b, ,c=d"
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		if p.peek() == ',' {
+			p.pos++
+			continue
+		}
+
+		name := strings.ToLower(p.token())
+		if name == "" {
+			return nil, &ParseError{Header: header, Reason: fmt.Sprintf("expected a parameter name at position %d", p.pos)}
+		}
+		p.skipSpaces()
+		if p.done() || p.peek() != '=' {
+			return nil, &ParseError{Header: header, Reason: fmt.Sprintf("expected '=' after %s", name)}
+		}
+		p.pos++
+		p.skipSpaces()
+
+		var value string
+		var err error
+		if !p.done() && p.peek() == '"' {
+			value, err = p.quotedString()
+			if err != nil {
+				return nil, &ParseError{Header: header, Reason: err.Error()}
+			}
+		} else {
+			value = p.unquotedValue()
+			if value == "" {
+				return nil, &ParseError{Header: header, Reason: fmt.Sprintf("missing value for %s", name)}
+			}
+		}
+
+		if _, ok := params[name]; ok {
+			return nil, &ParseError{Header: header, Reason: "duplicate parameter " + name}
+		}
+		params[name] = value
+
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, &ParseError{Header: header, Reason: fmt.Sprintf("expected ',' at position %d", p.pos)}
+		}
+		p.pos++
+	}
+
+	if len(params) == 0 {
+		return nil, &ParseError{Header: header, Reason: "no parameters"}
+	}
+	return params, nil
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) peek() byte {
+	return p.s[p.pos]
+}
+
+// skipSpaces skips optional whitespace, returning whether there was any.
+func (p *parser) skipSpaces() bool {
+	start := p.pos
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *parser) token() string {
+	start := p.pos
+	for !p.done() && isTchar(p.peek()) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *parser) unquotedValue() string {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if c <= ' ' || c >= 0x7f || c == ',' || c == '"' || c == '\\' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// quotedString reads a quoted-string, unescaping any quoted-pairs.
+func (p *parser) quotedString() (string, error) {
+	p.pos++ // opening quote
+	sb := strings.Builder{}
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == '"':
+			return sb.String(), nil
+		case c == '\\':
+			if p.done() {
+				return "", errors.New("unterminated escape in quoted string")
+			}
+			sb.WriteByte(p.peek())
+			p.pos++
+		case c == '\t' || (c >= ' ' && c != 0x7f):
+			sb.WriteByte(c)
+		default:
+			return "", fmt.Errorf("invalid character 0x%02x in quoted string", c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
+
+func isTchar(c byte) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
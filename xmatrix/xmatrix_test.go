@@ -0,0 +1,194 @@
+/*
+ * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xmatrix
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		auth   *Auth
+	}{
+		{
+			name:   "typical",
+			header: `X-Matrix origin="origin.example.org",destination="dest.example.org",key="ed25519:abc",sig="ABCdef+/123"`,
+			auth:   &Auth{"origin.example.org", "dest.example.org", "ed25519:abc", "ABCdef+/123"},
+		},
+		{
+			name:   "without destination",
+			header: `X-Matrix origin="origin.example.org",key="ed25519:abc",sig="ABCdef"`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "unquoted values",
+			header: `X-Matrix origin=origin.example.org,key=ed25519:abc,sig=ABC/def+`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABC/def+"},
+		},
+		{
+			name:   "padded signature",
+			header: `X-Matrix origin="origin.example.org",key="ed25519:abc",sig="ABCdef=="`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef=="},
+		},
+		{
+			name:   "unquoted padded signature",
+			header: `X-Matrix origin=origin.example.org,key=ed25519:abc,sig=ABCdef==`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef=="},
+		},
+		{
+			name:   "extra whitespace",
+			header: "X-Matrix   origin = \"origin.example.org\" ,\tkey=\"ed25519:abc\" ,  sig=\"ABCdef\"  ",
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "empty list elements",
+			header: `X-Matrix ,origin="origin.example.org",,key="ed25519:abc", ,sig="ABCdef",`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "case insensitive scheme and names",
+			header: `x-matrix ORIGIN="origin.example.org",Key="ed25519:abc",SIG="ABCdef"`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "parameters in any order",
+			header: `X-Matrix sig="ABCdef",key="ed25519:abc",destination="dest.example.org",origin="origin.example.org"`,
+			auth:   &Auth{"origin.example.org", "dest.example.org", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "comma and equals in quoted values",
+			header: `X-Matrix origin="origin.example.org",key="ed25519:a,b=c",sig="ABCdef"`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:a,b=c", "ABCdef"},
+		},
+		{
+			name:   "escaped characters in quoted values",
+			header: `X-Matrix origin="origin.example.org",key="ed25519:\"q\"\\",sig="ABC\def"`,
+			auth:   &Auth{"origin.example.org", "", `ed25519:"q"\`, "ABCdef"},
+		},
+		{
+			name:   "unknown parameters are ignored",
+			header: `X-Matrix origin="origin.example.org",key="ed25519:abc",sig="ABCdef",future=thing`,
+			auth:   &Auth{"origin.example.org", "", "ed25519:abc", "ABCdef"},
+		},
+		{
+			name:   "IPv6 origin with port",
+			header: `X-Matrix origin="[2001:db8::1]:8448",key="ed25519:abc",sig="ABCdef"`,
+			auth:   &Auth{"[2001:db8::1]:8448", "", "ed25519:abc", "ABCdef"},
+		},
+	}
+
+	for _, c := range cases {
+		a, err := Parse(c.header)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if *a != *c.auth {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.auth, a)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+	}{
+		{"scheme only", `X-Matrix`},
+		{"scheme and spaces", `X-Matrix   `},
+		{"missing origin", `X-Matrix key="ed25519:abc",sig="ABCdef"`},
+		{"missing key", `X-Matrix origin="origin.example.org",sig="ABCdef"`},
+		{"missing sig", `X-Matrix origin="origin.example.org",key="ed25519:abc"`},
+		{"empty origin", `X-Matrix origin="",key="ed25519:abc",sig="ABCdef"`},
+		{"empty destination", `X-Matrix origin="origin.example.org",destination="",key="ed25519:abc",sig="ABCdef"`},
+		{"missing value", `X-Matrix origin=,key="ed25519:abc",sig="ABCdef"`},
+		{"missing equals", `X-Matrix origin "origin.example.org",key="ed25519:abc",sig="ABCdef"`},
+		{"missing comma", `X-Matrix origin="origin.example.org" key="ed25519:abc",sig="ABCdef"`},
+		{"no space after scheme", `X-Matrix,origin="origin.example.org",key="ed25519:abc",sig="ABCdef"`},
+		{"unterminated quote", `X-Matrix origin="origin.example.org,key="ed25519:abc",sig="ABCdef`},
+		{"unterminated escape", `X-Matrix origin="origin.example.org",key="ed25519:abc",sig="ABCdef\`},
+		{"control character", "X-Matrix origin=\"origin\x01.example.org\",key=\"ed25519:abc\",sig=\"ABCdef\""},
+		{"duplicate parameter", `X-Matrix origin="a.example.org",origin="b.example.org",key="ed25519:abc",sig="ABCdef"`},
+		{"duplicate parameter with different case", `X-Matrix origin="a.example.org",ORIGIN="b.example.org",key="ed25519:abc",sig="ABCdef"`},
+		{"bad parameter name", `X-Matrix "origin"="origin.example.org",key="ed25519:abc",sig="ABCdef"`},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.header)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%s: expected a ParseError, got %v", c.name, err)
+		}
+	}
+}
+
+func TestParse_OtherScheme(t *testing.T) {
+	for _, header := range []string{"", "Bearer abc123", `X-Matrixy origin="a"`, "Basic dXNlcjpwYXNz"} {
+		_, err := Parse(header)
+		if err != ErrNotXMatrix {
+			t.Errorf("%q: expected ErrNotXMatrix, got %v", header, err)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	auths, err := ParseAll([]string{
+		`Bearer abc123`,
+		`X-Matrix origin="origin.example.org",key="ed25519:a",sig="AAA"`,
+		`X-Matrix origin="origin.example.org",key="ed25519:b",sig="BBB"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auths) != 2 || auths[0].KeyID != "ed25519:a" || auths[1].KeyID != "ed25519:b" {
+		t.Errorf("Unexpected result: %+v", auths)
+	}
+
+	_, err = ParseAll([]string{`Bearer abc123`})
+	if err != ErrNotXMatrix {
+		t.Errorf("Expected ErrNotXMatrix without any X-Matrix headers, got %v", err)
+	}
+
+	_, err = ParseAll([]string{
+		`X-Matrix origin="origin.example.org",key="ed25519:a",sig="AAA"`,
+		`X-Matrix origin="origin.example.org",key="ed25519:b"`,
+	})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("Expected a ParseError when any header is invalid, got %v", err)
+	}
+}
+
+func TestAuth_String(t *testing.T) {
+	a := &Auth{"origin.example.org", "dest.example.org", "ed25519:abc", "ABC/def+"}
+	s := a.String()
+	if s != `X-Matrix origin="origin.example.org",destination="dest.example.org",key="ed25519:abc",sig="ABC/def+"` {
+		t.Errorf("Unexpected header: %s", s)
+	}
+
+	a = &Auth{`odd"origin\`, "", "ed25519:abc", "ABC"}
+	parsed, err := Parse(a.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *a {
+		t.Errorf("Expected %+v to round trip, got %+v", a, parsed)
+	}
+}